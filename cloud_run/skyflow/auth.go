@@ -0,0 +1,381 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math/big"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // Google's JSON Web Key Set used to sign ID tokens
+    googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+    // Cache duration for the JWKS when the response has no max-age
+    jwksDefaultCacheDuration = 1 * time.Hour
+    // Minimum time between JWKS refreshes triggered by an unknown key ID
+    jwksMinRefreshInterval = 1 * time.Minute
+    // Upper bound of a JWKS fetch
+    jwksFetchTimeout = 10 * time.Second
+
+    // Allowed clock skew when checking token times
+    idTokenClockSkew = 1 * time.Minute
+)
+
+// Issuers of Google-signed ID tokens
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// IDTokenClaims holds the claims checked on the caller's Google-signed ID token
+type IDTokenClaims struct {
+    Issuer        string      `json:"iss"`
+    Audience      interface{} `json:"aud"` // string or list of strings
+    Subject       string      `json:"sub"`
+    Email         string      `json:"email"`
+    EmailVerified bool        `json:"email_verified"`
+    IssuedAt      int64       `json:"iat"`
+    Expiry        int64       `json:"exp"`
+}
+
+// hasAudience reports whether the token was issued for the given audience, ignoring trailing slashes
+func (c *IDTokenClaims) hasAudience(audience string) bool {
+    switch aud := c.Audience.(type) {
+    case string:
+        return strings.TrimRight(aud, "/") == audience
+    case []interface{}:
+        for _, a := range aud {
+            if s, ok := a.(string); ok && strings.TrimRight(s, "/") == audience {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+type callerContextKey struct{}
+
+// callerFromContext returns the verified caller identity stored by requireIdentityToken
+func callerFromContext(ctx context.Context) (*IDTokenClaims, bool) {
+    claims, ok := ctx.Value(callerContextKey{}).(*IDTokenClaims)
+    return claims, ok
+}
+
+// authConfig holds the settings used to verify callers
+type authConfig struct {
+    audience       string          // Expected token audience (the service URL)
+    allowedCallers map[string]bool // Allowed caller emails (BigQuery connection service accounts)
+}
+
+// loadAuthConfig loads the caller verification settings from the environment
+func loadAuthConfig() authConfig {
+    config := authConfig{
+        audience:       strings.TrimRight(os.Getenv("SERVICE_URL"), "/"),
+        allowedCallers: make(map[string]bool),
+    }
+    for _, caller := range strings.Split(os.Getenv("ALLOWED_CALLER_SERVICE_ACCOUNTS"), ",") {
+        caller = strings.ToLower(strings.TrimSpace(caller))
+        if caller != "" {
+            config.allowedCallers[caller] = true
+        }
+    }
+    return config
+}
+
+// requireIdentityToken wraps a handler so that it only runs for requests carrying a valid
+// Google-signed ID token issued to an allowed service account for this service's URL.
+// Requests without a valid token are rejected with 401 and other callers with 403.
+func requireIdentityToken(next http.HandlerFunc) http.HandlerFunc {
+    config := loadAuthConfig()
+    if config.audience == "" {
+        log.Printf("[WARN] SERVICE_URL is not set, all requests will be rejected")
+    }
+    if len(config.allowedCallers) == 0 {
+        log.Printf("[WARN] ALLOWED_CALLER_SERVICE_ACCOUNTS is not set, all requests will be rejected")
+    }
+
+    return func(w http.ResponseWriter, r *http.Request) {
+        claims, err := verifyRequestIdentity(r, config)
+        if err != nil {
+            log.Printf("[WARN] Rejected request from %s: %v", r.RemoteAddr, err)
+            writeError(w, err)
+            return
+        }
+        log.Printf("[INFO] Verified caller identity: %s", claims.Email)
+        next(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, claims)))
+    }
+}
+
+// verifyRequestIdentity verifies the bearer ID token of a request against the auth config
+func verifyRequestIdentity(r *http.Request, config authConfig) (*IDTokenClaims, error) {
+    if config.audience == "" || len(config.allowedCallers) == 0 {
+        return nil, &requestError{status: http.StatusUnauthorized, err: errors.New("caller verification is not configured")}
+    }
+
+    authHeader := r.Header.Get("Authorization")
+    if !strings.HasPrefix(authHeader, "Bearer ") {
+        return nil, &requestError{status: http.StatusUnauthorized, err: errors.New("missing bearer token")}
+    }
+
+    claims, err := verifyIDToken(strings.TrimPrefix(authHeader, "Bearer "), config.audience)
+    var reqErr *requestError
+    if errors.As(err, &reqErr) {
+        return nil, err
+    }
+    if err != nil {
+        return nil, &requestError{status: http.StatusUnauthorized, err: fmt.Errorf("invalid identity token: %v", err)}
+    }
+
+    if !claims.EmailVerified || !config.allowedCallers[strings.ToLower(claims.Email)] {
+        return nil, &requestError{status: http.StatusForbidden, err: fmt.Errorf("caller %s is not allowed", claims.Email)}
+    }
+
+    return claims, nil
+}
+
+// verifyIDToken verifies the signature, issuer, audience and validity period of a Google ID token
+func verifyIDToken(token string, audience string) (*IDTokenClaims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed token")
+    }
+
+    var header struct {
+        Algorithm string `json:"alg"`
+        KeyID     string `json:"kid"`
+    }
+    if err := decodeJWTSegment(parts[0], &header); err != nil {
+        return nil, fmt.Errorf("invalid header: %v", err)
+    }
+    if header.Algorithm != "RS256" {
+        return nil, fmt.Errorf("unsupported signing algorithm %q", header.Algorithm)
+    }
+
+    key, err := googleKeys.key(header.KeyID)
+    if err != nil {
+        return nil, err
+    }
+
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, fmt.Errorf("invalid signature encoding: %v", err)
+    }
+    hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+        return nil, errors.New("invalid signature")
+    }
+
+    var claims IDTokenClaims
+    if err := decodeJWTSegment(parts[1], &claims); err != nil {
+        return nil, fmt.Errorf("invalid claims: %v", err)
+    }
+
+    validIssuer := false
+    for _, issuer := range googleIssuers {
+        if claims.Issuer == issuer {
+            validIssuer = true
+            break
+        }
+    }
+    if !validIssuer {
+        return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+    }
+
+    if !claims.hasAudience(audience) {
+        return nil, fmt.Errorf("unexpected audience %v", claims.Audience)
+    }
+
+    now := time.Now()
+    if now.After(time.Unix(claims.Expiry, 0).Add(idTokenClockSkew)) {
+        return nil, errors.New("token expired")
+    }
+    if now.Before(time.Unix(claims.IssuedAt, 0).Add(-idTokenClockSkew)) {
+        return nil, errors.New("token issued in the future")
+    }
+
+    return &claims, nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JWT segment into v
+func decodeJWTSegment(segment string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// jwksCache caches the public keys used to verify Google ID tokens. Keys are loaded from
+// GOOGLE_JWKS_FILE when it is set (for local testing) and from Google's JWKS endpoint otherwise.
+type jwksCache struct {
+    sync.RWMutex
+    keys        map[string]*rsa.PublicKey
+    expiry      time.Time
+    lastRefresh time.Time
+
+    refreshMutex sync.Mutex // Serializes key set fetches, which run without holding the key lock
+}
+
+var (
+    googleKeys = &jwksCache{}
+
+    // Client for fetching Google's JWKS, bounded so a hung connection can't stall callers
+    jwksClient = &http.Client{Timeout: jwksFetchTimeout}
+)
+
+// key returns the public key with the given key ID, refreshing the key set if needed. Requests
+// for cached keys never wait for a refresh.
+func (c *jwksCache) key(keyID string) (*rsa.PublicKey, error) {
+    c.RLock()
+    key, ok := c.keys[keyID]
+    fresh := time.Now().Before(c.expiry)
+    c.RUnlock()
+    if ok && fresh {
+        return key, nil
+    }
+
+    c.refreshMutex.Lock()
+    defer c.refreshMutex.Unlock()
+
+    // Double check, another request may have refreshed the keys meanwhile
+    c.RLock()
+    key, ok = c.keys[keyID]
+    fresh = time.Now().Before(c.expiry)
+    loaded := c.keys != nil
+    lastRefresh := c.lastRefresh
+    c.RUnlock()
+    if ok && fresh {
+        return key, nil
+    }
+
+    // Refresh when the cache expired or the key is unknown (the keys may have rotated),
+    // at most once per refresh interval so unknown key IDs can't flood Google's endpoint
+    if !loaded || time.Since(lastRefresh) >= jwksMinRefreshInterval {
+        keys, cacheDuration, err := fetchJWKS()
+
+        c.Lock()
+        c.lastRefresh = time.Now()
+        if err == nil {
+            c.keys = keys
+            c.expiry = time.Now().Add(cacheDuration)
+        }
+        c.Unlock()
+
+        if err != nil {
+            log.Printf("[ERROR] Failed to refresh Google JWKS: %v", err)
+            if !loaded {
+                return nil, &requestError{status: http.StatusServiceUnavailable, err: fmt.Errorf("failed to load Google JWKS: %v", err)}
+            }
+        } else {
+            log.Printf("[INFO] Loaded %d Google JWKS keys, cached for %v", len(keys), cacheDuration)
+        }
+    }
+
+    c.RLock()
+    key, ok = c.keys[keyID]
+    c.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown key ID %q", keyID)
+    }
+    return key, nil
+}
+
+// fetchJWKS loads the key set and returns it with the time it may be cached for
+func fetchJWKS() (map[string]*rsa.PublicKey, time.Duration, error) {
+    var data []byte
+    cacheDuration := jwksDefaultCacheDuration
+    if path := os.Getenv("GOOGLE_JWKS_FILE"); path != "" {
+        fileData, err := ioutil.ReadFile(path)
+        if err != nil {
+            return nil, 0, fmt.Errorf("failed to read JWKS file: %v", err)
+        }
+        data = fileData
+    } else {
+        resp, err := jwksClient.Get(googleJWKSURL)
+        if err != nil {
+            return nil, 0, err
+        }
+        defer resp.Body.Close()
+
+        body, err := ioutil.ReadAll(resp.Body)
+        if err != nil {
+            return nil, 0, err
+        }
+        if resp.StatusCode != http.StatusOK {
+            return nil, 0, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+        }
+        data = body
+        if maxAge, ok := cacheMaxAge(resp.Header.Get("Cache-Control")); ok {
+            cacheDuration = maxAge
+        }
+    }
+
+    keys, err := parseJWKS(data)
+    if err != nil {
+        return nil, 0, err
+    }
+    return keys, cacheDuration, nil
+}
+
+// parseJWKS parses the RSA keys of a JSON Web Key Set
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+    var jwks struct {
+        Keys []struct {
+            KeyID   string `json:"kid"`
+            KeyType string `json:"kty"`
+            N       string `json:"n"`
+            E       string `json:"e"`
+        } `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &jwks); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal JWKS: %v", err)
+    }
+
+    keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+    for _, jwk := range jwks.Keys {
+        if jwk.KeyType != "RSA" {
+            continue
+        }
+        n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+        if err != nil {
+            return nil, fmt.Errorf("invalid modulus for key %s: %v", jwk.KeyID, err)
+        }
+        e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+        if err != nil {
+            return nil, fmt.Errorf("invalid exponent for key %s: %v", jwk.KeyID, err)
+        }
+        keys[jwk.KeyID] = &rsa.PublicKey{
+            N: new(big.Int).SetBytes(n),
+            E: int(new(big.Int).SetBytes(e).Int64()),
+        }
+    }
+    if len(keys) == 0 {
+        return nil, errors.New("no RSA keys in JWKS")
+    }
+    return keys, nil
+}
+
+// cacheMaxAge extracts the max-age directive of a Cache-Control header
+func cacheMaxAge(cacheControl string) (time.Duration, bool) {
+    for _, directive := range strings.Split(cacheControl, ",") {
+        directive = strings.TrimSpace(directive)
+        if strings.HasPrefix(directive, "max-age=") {
+            seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+            if err == nil && seconds > 0 {
+                return time.Duration(seconds) * time.Second, true
+            }
+        }
+    }
+    return 0, false
+}
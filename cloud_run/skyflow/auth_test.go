@@ -0,0 +1,179 @@
+package main
+
+import (
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+const (
+    testServiceURL = "https://skyflow-abc.a.run.app"
+    testCaller     = "bq-connection@example-project.iam.gserviceaccount.com"
+)
+
+// useTestJWKS serves the given key as the only Google JWKS key, with ID k1, through
+// GOOGLE_JWKS_FILE
+func useTestJWKS(t *testing.T, key *rsa.PrivateKey) {
+    t.Helper()
+    jwks, err := json.Marshal(map[string]interface{}{
+        "keys": []map[string]string{{
+            "kid": "k1",
+            "kty": "RSA",
+            "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "jwks.json")
+    if err := os.WriteFile(path, jwks, 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("GOOGLE_JWKS_FILE", path)
+    googleKeys = &jwksCache{}
+}
+
+// signTestIDToken signs an RS256 ID token with the given key ID and claims
+func signTestIDToken(t *testing.T, key *rsa.PrivateKey, keyID string, claims map[string]interface{}) string {
+    t.Helper()
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": keyID})
+    payload, _ := json.Marshal(claims)
+    unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    hash := sha256.Sum256([]byte(unsigned))
+    signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestRequireIdentityToken(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    useTestJWKS(t, key)
+    t.Setenv("SERVICE_URL", testServiceURL+"/")
+    t.Setenv("ALLOWED_CALLER_SERVICE_ACCOUNTS", testCaller)
+
+    now := time.Now().Unix()
+    claims := func(changes map[string]interface{}) map[string]interface{} {
+        c := map[string]interface{}{
+            "iss":            "https://accounts.google.com",
+            "aud":            testServiceURL,
+            "email":          testCaller,
+            "email_verified": true,
+            "iat":            now,
+            "exp":            now + 600,
+        }
+        for k, v := range changes {
+            c[k] = v
+        }
+        return c
+    }
+
+    tests := []struct {
+        name          string
+        authorization string
+        wantStatus    int
+    }{
+        {"valid token", "Bearer " + signTestIDToken(t, key, "k1", claims(nil)), http.StatusOK},
+        {"audience with trailing slash", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"aud": testServiceURL + "/"})), http.StatusOK},
+        {"audience list", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"aud": []string{"other", testServiceURL}})), http.StatusOK},
+        {"wrong audience", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"aud": "https://other.a.run.app"})), http.StatusUnauthorized},
+        {"expired", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"exp": now - 3600})), http.StatusUnauthorized},
+        {"expired within clock skew", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"exp": now - 30})), http.StatusOK},
+        {"issued in the future", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"iat": now + 3600})), http.StatusUnauthorized},
+        {"wrong issuer", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"iss": "https://evil.example.com"})), http.StatusUnauthorized},
+        {"unknown key ID", "Bearer " + signTestIDToken(t, key, "k2", claims(nil)), http.StatusUnauthorized},
+        {"signed with another key", "Bearer " + signTestIDToken(t, otherKey, "k1", claims(nil)), http.StatusUnauthorized},
+        {"caller not allowed", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"email": "someone@example.com"})), http.StatusForbidden},
+        {"email not verified", "Bearer " + signTestIDToken(t, key, "k1", claims(map[string]interface{}{"email_verified": false})), http.StatusForbidden},
+        {"malformed token", "Bearer not-a-jwt", http.StatusUnauthorized},
+        {"missing bearer token", "", http.StatusUnauthorized},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            called := false
+            handler := requireIdentityToken(func(w http.ResponseWriter, r *http.Request) {
+                called = true
+                if _, ok := callerFromContext(r.Context()); !ok {
+                    t.Error("caller identity missing from request context")
+                }
+            })
+
+            r := httptest.NewRequest(http.MethodPost, "/", nil)
+            if tt.authorization != "" {
+                r.Header.Set("Authorization", tt.authorization)
+            }
+            w := httptest.NewRecorder()
+            handler(w, r)
+
+            if w.Code != tt.wantStatus {
+                t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+            }
+            if called != (tt.wantStatus == http.StatusOK) {
+                t.Errorf("handler called = %t, want %t", called, tt.wantStatus == http.StatusOK)
+            }
+        })
+    }
+}
+
+func TestRequireIdentityTokenNotConfigured(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    useTestJWKS(t, key)
+    t.Setenv("SERVICE_URL", testServiceURL)
+    t.Setenv("ALLOWED_CALLER_SERVICE_ACCOUNTS", "")
+
+    handler := requireIdentityToken(func(w http.ResponseWriter, r *http.Request) {
+        t.Error("handler called without caller verification configured")
+    })
+    r := httptest.NewRequest(http.MethodPost, "/", nil)
+    r.Header.Set("Authorization", "Bearer "+signTestIDToken(t, key, "k1", map[string]interface{}{
+        "iss": "https://accounts.google.com", "aud": testServiceURL, "email": testCaller,
+        "email_verified": true, "iat": time.Now().Unix(), "exp": time.Now().Unix() + 600,
+    }))
+    w := httptest.NewRecorder()
+    handler(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+    }
+}
+
+func TestCacheMaxAge(t *testing.T) {
+    tests := []struct {
+        header string
+        want   time.Duration
+        wantOK bool
+    }{
+        {"public, max-age=21600, must-revalidate, no-transform", 6 * time.Hour, true},
+        {"max-age=0", 0, false},
+        {"no-cache", 0, false},
+        {"", 0, false},
+    }
+    for _, tt := range tests {
+        got, ok := cacheMaxAge(tt.header)
+        if got != tt.want || ok != tt.wantOK {
+            t.Errorf("cacheMaxAge(%q) = %v, %t, want %v, %t", tt.header, got, ok, tt.want, tt.wantOK)
+        }
+    }
+}
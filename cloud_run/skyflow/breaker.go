@@ -0,0 +1,217 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Circuit breaker states
+const (
+    CircuitClosed   = "closed"    // Calls pass through and their outcomes are counted
+    CircuitOpen     = "open"      // Calls fail immediately until the cooldown has passed
+    CircuitHalfOpen = "half_open" // One probe call is let through to test whether Skyflow recovered
+)
+
+// circuitBreaker fails calls to a Skyflow endpoint fast while the endpoint's recent failure rate
+// is too high, so a degraded Skyflow isn't sent every BigQuery row
+type circuitBreaker struct {
+    sync.Mutex
+    endpoint    string
+    state       string
+    windowStart time.Time // Start of the current failure rate window
+    requests    int       // Calls completed in the current window
+    failures    int       // Calls failed in the current window
+    openedAt    time.Time
+    probing     bool // A half-open probe call is in progress
+    lastError   string
+
+    window      time.Duration
+    minRequests int
+    threshold   float64 // Failure rate that opens the circuit
+    cooldown    time.Duration
+}
+
+// circuitOpenError is returned for calls rejected by an open circuit
+type circuitOpenError struct {
+    endpoint   string
+    retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+    return fmt.Sprintf("Skyflow %s is failing, circuit open for another %v", e.endpoint, e.retryAfter.Round(time.Second))
+}
+
+var (
+    breakersMutex sync.Mutex
+    breakers      = make(map[string]*circuitBreaker)
+)
+
+// breakerEndpoint returns the endpoint a Skyflow API path is tracked under. Table inserts are
+// tracked together.
+func breakerEndpoint(path string) string {
+    switch path {
+    case "/tokenize", "/detokenize":
+        return path
+    }
+    if strings.Count(path, "/") == 1 {
+        return "insert"
+    }
+    return path
+}
+
+// getCircuitBreaker returns the circuit breaker of a Skyflow API path, configured with
+// SKYFLOW_BREAKER_* variables
+func getCircuitBreaker(path string) *circuitBreaker {
+    endpoint := breakerEndpoint(path)
+    breakersMutex.Lock()
+    defer breakersMutex.Unlock()
+    if breaker, ok := breakers[endpoint]; ok {
+        return breaker
+    }
+    breaker := &circuitBreaker{
+        endpoint:    endpoint,
+        state:       CircuitClosed,
+        window:      time.Duration(getBatchSize("SKYFLOW_BREAKER_WINDOW_SECONDS", 60)) * time.Second,
+        minRequests: getBatchSize("SKYFLOW_BREAKER_MIN_REQUESTS", 20),
+        threshold:   float64(getBatchSize("SKYFLOW_BREAKER_FAILURE_PERCENT", 50)) / 100,
+        cooldown:    time.Duration(getBatchSize("SKYFLOW_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+    }
+    breakers[endpoint] = breaker
+    return breaker
+}
+
+// allow reports whether a call may proceed. An open circuit turns half-open once the cooldown
+// has passed and lets one probe call through.
+func (b *circuitBreaker) allow() error {
+    b.Lock()
+    defer b.Unlock()
+    switch b.state {
+    case CircuitOpen:
+        remaining := b.cooldown - time.Since(b.openedAt)
+        if remaining > 0 {
+            return &circuitOpenError{endpoint: b.endpoint, retryAfter: remaining}
+        }
+        log.Printf("[INFO] Circuit for Skyflow %s is half-open, probing", b.endpoint)
+        b.state = CircuitHalfOpen
+        b.probing = true
+        return nil
+    case CircuitHalfOpen:
+        if b.probing {
+            return &circuitOpenError{endpoint: b.endpoint, retryAfter: time.Second}
+        }
+        b.probing = true
+        return nil
+    }
+    return nil
+}
+
+// release ends a call that was cancelled by the caller without counting it, so a half-open
+// circuit can probe again
+func (b *circuitBreaker) release() {
+    b.Lock()
+    defer b.Unlock()
+    b.probing = false
+}
+
+// record counts the outcome of a call. A failed probe reopens the circuit and a successful one
+// closes it; otherwise the circuit opens once the window's failure rate reaches the threshold.
+func (b *circuitBreaker) record(failure error) {
+    b.Lock()
+    defer b.Unlock()
+    now := time.Now()
+
+    if b.state == CircuitHalfOpen {
+        b.probing = false
+        if failure != nil {
+            b.open(now, failure)
+            return
+        }
+        log.Printf("[INFO] Circuit for Skyflow %s closed, probe succeeded", b.endpoint)
+        b.state = CircuitClosed
+        b.windowStart, b.requests, b.failures = now, 0, 0
+        return
+    }
+    if b.state == CircuitOpen {
+        // Call started before the circuit opened
+        return
+    }
+
+    if now.Sub(b.windowStart) > b.window {
+        b.windowStart, b.requests, b.failures = now, 0, 0
+    }
+    b.requests++
+    if failure != nil {
+        b.failures++
+        b.lastError = failure.Error()
+    }
+    if b.requests >= b.minRequests && float64(b.failures) >= b.threshold*float64(b.requests) {
+        b.open(now, failure)
+    }
+}
+
+// open trips the circuit. Must be called with the lock held.
+func (b *circuitBreaker) open(now time.Time, failure error) {
+    if failure != nil {
+        b.lastError = failure.Error()
+    }
+    log.Printf("[ERROR] Circuit for Skyflow %s opened after %d of %d calls failed, failing fast for %v: %s",
+        b.endpoint, b.failures, b.requests, b.cooldown, b.lastError)
+    b.state = CircuitOpen
+    b.openedAt = now
+}
+
+// isBreakerFailure reports whether a Skyflow response status counts as a failure of the
+// endpoint. Timeouts and server errors count; rate limiting and client errors don't.
+func isBreakerFailure(status int) bool {
+    return status == http.StatusRequestTimeout || status >= 500
+}
+
+// circuitStatus is the health report of one circuit breaker. The health endpoint is public, so
+// it holds only the state and counts; failure details are logged.
+type circuitStatus struct {
+    State    string     `json:"state"`
+    Requests int        `json:"requests"`
+    Failures int        `json:"failures"`
+    OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// status returns the breaker's current state
+func (b *circuitBreaker) status() circuitStatus {
+    b.Lock()
+    defer b.Unlock()
+    status := circuitStatus{State: b.state, Requests: b.requests, Failures: b.failures}
+    if b.state != CircuitClosed {
+        openedAt := b.openedAt
+        status.OpenedAt = &openedAt
+    }
+    return status
+}
+
+// handleHealth reports the state of the Skyflow circuit breakers. The status is degraded while
+// any circuit is open; the response is still 200 so instances aren't restarted for a Skyflow
+// outage. The endpoint isn't authenticated, so no error details are reported.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+    breakersMutex.Lock()
+    circuits := make(map[string]circuitStatus, len(breakers))
+    for endpoint, breaker := range breakers {
+        circuits[endpoint] = breaker.status()
+    }
+    breakersMutex.Unlock()
+
+    health := "ok"
+    for _, circuit := range circuits {
+        if circuit.State != CircuitClosed {
+            health = "degraded"
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": health, "circuits": circuits}); err != nil {
+        log.Printf("[ERROR] Failed to encode health response: %v", err)
+    }
+}
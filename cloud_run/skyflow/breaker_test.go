@@ -0,0 +1,48 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestHandleHealth(t *testing.T) {
+    secret := "vault 123 rejected token for alice@example.com"
+    breaker := &circuitBreaker{endpoint: "/detokenize", state: CircuitClosed, window: time.Minute, minRequests: 1, threshold: 0.5, cooldown: time.Minute}
+    breaker.record(errors.New(secret))
+
+    breakersMutex.Lock()
+    saved := breakers
+    breakers = map[string]*circuitBreaker{"/detokenize": breaker}
+    breakersMutex.Unlock()
+    defer func() {
+        breakersMutex.Lock()
+        breakers = saved
+        breakersMutex.Unlock()
+    }()
+
+    w := httptest.NewRecorder()
+    handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+    if w.Code != http.StatusOK {
+        t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+    }
+    if strings.Contains(w.Body.String(), "alice") || strings.Contains(w.Body.String(), "vault 123") {
+        t.Errorf("health response reveals error details: %s", w.Body.String())
+    }
+    var health struct {
+        Status   string                   `json:"status"`
+        Circuits map[string]circuitStatus `json:"circuits"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+        t.Fatal(err)
+    }
+    circuit := health.Circuits["/detokenize"]
+    if health.Status != "degraded" || circuit.State != CircuitOpen || circuit.Requests != 1 || circuit.Failures != 1 {
+        t.Errorf("health = %+v, want a degraded status with the open circuit's counts", health)
+    }
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Checkpoint phases of a column in a tokenize run
+const (
+    // Values up to the cursor have been tokenized and written to the staging table
+    PhaseStaging = "STAGING"
+    // All values have been tokenized and written to the staging table
+    PhaseStaged = "STAGED"
+    // The staged tokens have been merged into the table
+    PhaseMerged = "MERGED"
+    // Not a column: the row holds the lease of the run (see checkpointStore.Acquire)
+    PhaseLease = "LEASE"
+)
+
+// Column name of a run's lease row. Column names are validated identifiers, so no column
+// checkpoint can use it.
+const leaseColumn = "#lease"
+
+// columnCheckpoint records the progress of tokenizing one column
+type columnCheckpoint struct {
+    Column      string
+    Phase       string
+    Cursor      string         // Largest original value written to the staging table
+    Count       int            // Number of values written to the staging table
+    Skipped     int            // Number of values skipped because they are already tokens
+    ShortValues map[string]int // Number of short values per short value policy applied
+    UpdatedAt   time.Time
+}
+
+// checkpointStore persists tokenize run checkpoints so an interrupted run can resume, and the
+// leases that keep two instances from making progress on the same run
+type checkpointStore interface {
+    Load(ctx context.Context, runKey string) (map[string]*columnCheckpoint, error)
+    Save(ctx context.Context, runKey string, checkpoint *columnCheckpoint) error
+    // Clear deletes the checkpoints of a run, but not its lease
+    Clear(ctx context.Context, runKey string) error
+    // Acquire takes the lease of a run for owner unless another owner holds it, and reports
+    // whether owner holds it
+    Acquire(ctx context.Context, runKey string, owner string, at time.Time) (bool, error)
+    // Release gives up owner's lease of a run
+    Release(ctx context.Context, runKey string, owner string) error
+    // Heartbeat renews owner's leases of the runs, showing they are still making progress
+    Heartbeat(ctx context.Context, runKeys []string, owner string, at time.Time) error
+    // ExpireLeases drops leases that weren't renewed since the given time, so runs whose instance
+    // stopped can be resumed
+    ExpireLeases(ctx context.Context, before time.Time) error
+}
+
+var (
+    checkpointsOnce sync.Once
+    checkpoints     checkpointStore
+
+    leaseOwnerOnce sync.Once
+    leaseOwner     string
+)
+
+// getCheckpointStore returns the configured checkpoint store
+func getCheckpointStore() checkpointStore {
+    checkpointsOnce.Do(func() {
+        if tableName := os.Getenv("CHECKPOINTS_TABLE"); tableName != "" {
+            table, err := parseTableName(tableName)
+            if err != nil {
+                log.Fatalf("[FATAL] Invalid CHECKPOINTS_TABLE: %v", err)
+            }
+            checkpoints = &bigQueryCheckpointStore{table: table}
+            log.Printf("[INFO] Using BigQuery checkpoint store: %s", table)
+            return
+        }
+        checkpoints = newMemoryCheckpointStore()
+        log.Printf("[WARN] CHECKPOINTS_TABLE is not set, tokenize checkpoints are kept in memory and lost on restart")
+    })
+    return checkpoints
+}
+
+// getLeaseOwner returns the ID this instance holds run leases under, created on first use
+func getLeaseOwner() string {
+    leaseOwnerOnce.Do(func() {
+        id, err := newJobID()
+        if err != nil {
+            log.Fatalf("[FATAL] Failed to generate lease owner ID: %v", err)
+        }
+        leaseOwner = id
+    })
+    return leaseOwner
+}
+
+// tokenizeRunKey identifies the tokenize run for a table, set of columns, destination and row
+// filter, so that repeating an interrupted call resumes the same run
+func tokenizeRunKey(params *tokenizeTableParams) string {
+    columns := make([]string, len(params.Columns))
+    for i, column := range params.Columns {
+        columns[i] = strings.ToLower(column)
+    }
+    key := params.Table.String() + "|" + strings.Join(columns, ",")
+    if params.Destination != nil {
+        key += "|" + params.Destination.String()
+    }
+    if params.Filter != nil {
+        filter, _ := json.Marshal(params.Filter)
+        key += "|" + string(filter)
+    }
+    hash := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(hash[:8])
+}
+
+// runLease records which owner holds the lease of a run and when it was last renewed
+type runLease struct {
+    owner     string
+    renewedAt time.Time
+}
+
+// memoryCheckpointStore keeps checkpoints in memory. Used when no checkpoints table is configured.
+type memoryCheckpointStore struct {
+    sync.Mutex
+    runs   map[string]map[string]columnCheckpoint
+    leases map[string]runLease
+}
+
+func newMemoryCheckpointStore() *memoryCheckpointStore {
+    return &memoryCheckpointStore{
+        runs:   make(map[string]map[string]columnCheckpoint),
+        leases: make(map[string]runLease),
+    }
+}
+
+func (s *memoryCheckpointStore) Load(ctx context.Context, runKey string) (map[string]*columnCheckpoint, error) {
+    s.Lock()
+    defer s.Unlock()
+    result := make(map[string]*columnCheckpoint)
+    for column, checkpoint := range s.runs[runKey] {
+        checkpoint := checkpoint
+        result[column] = &checkpoint
+    }
+    return result, nil
+}
+
+func (s *memoryCheckpointStore) Save(ctx context.Context, runKey string, checkpoint *columnCheckpoint) error {
+    s.Lock()
+    defer s.Unlock()
+    if s.runs[runKey] == nil {
+        s.runs[runKey] = make(map[string]columnCheckpoint)
+    }
+    saved := *checkpoint
+    saved.ShortValues = make(map[string]int, len(checkpoint.ShortValues))
+    for action, count := range checkpoint.ShortValues {
+        saved.ShortValues[action] = count
+    }
+    s.runs[runKey][checkpoint.Column] = saved
+    return nil
+}
+
+func (s *memoryCheckpointStore) Clear(ctx context.Context, runKey string) error {
+    s.Lock()
+    defer s.Unlock()
+    delete(s.runs, runKey)
+    return nil
+}
+
+func (s *memoryCheckpointStore) Acquire(ctx context.Context, runKey string, owner string, at time.Time) (bool, error) {
+    s.Lock()
+    defer s.Unlock()
+    if lease, ok := s.leases[runKey]; ok && lease.owner != owner {
+        return false, nil
+    }
+    s.leases[runKey] = runLease{owner: owner, renewedAt: at}
+    return true, nil
+}
+
+func (s *memoryCheckpointStore) Release(ctx context.Context, runKey string, owner string) error {
+    s.Lock()
+    defer s.Unlock()
+    if lease, ok := s.leases[runKey]; ok && lease.owner == owner {
+        delete(s.leases, runKey)
+    }
+    return nil
+}
+
+func (s *memoryCheckpointStore) Heartbeat(ctx context.Context, runKeys []string, owner string, at time.Time) error {
+    s.Lock()
+    defer s.Unlock()
+    for _, runKey := range runKeys {
+        if lease, ok := s.leases[runKey]; ok && lease.owner == owner {
+            lease.renewedAt = at
+            s.leases[runKey] = lease
+        }
+    }
+    return nil
+}
+
+func (s *memoryCheckpointStore) ExpireLeases(ctx context.Context, before time.Time) error {
+    s.Lock()
+    defer s.Unlock()
+    for runKey, lease := range s.leases {
+        if lease.renewedAt.Before(before) {
+            log.Printf("[WARN] Expiring lease of run %s, last renewed at %s", runKey, lease.renewedAt.Format(time.RFC3339))
+            delete(s.leases, runKey)
+        }
+    }
+    return nil
+}
+
+// bigQueryCheckpointStore keeps checkpoints in a BigQuery control table (see sql/create_checkpoints_table.sql)
+type bigQueryCheckpointStore struct {
+    table tableRef
+}
+
+func (s *bigQueryCheckpointStore) Load(ctx context.Context, runKey string) (map[string]*columnCheckpoint, error) {
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return nil, err
+    }
+    defer bq.Close()
+
+    query := fmt.Sprintf(`
+SELECT column_name, phase, cursor, value_count, skipped_count, short_values, updated_at
+FROM %s
+WHERE run_key = @run_key AND column_name != @lease_column`, s.table.sql())
+    rows, err := bq.Query(ctx, query,
+        bigquery.QueryParameter{Name: "run_key", Value: runKey},
+        bigquery.QueryParameter{Name: "lease_column", Value: leaseColumn})
+    if err != nil {
+        return nil, fmt.Errorf("error loading checkpoints: %w", err)
+    }
+
+    result := make(map[string]*columnCheckpoint, len(rows))
+    for _, row := range rows {
+        checkpoint := &columnCheckpoint{
+            Column: stringValue(row[0]),
+            Phase:  stringValue(row[1]),
+            Cursor: stringValue(row[2]),
+        }
+        if count, ok := row[3].(int64); ok {
+            checkpoint.Count = int(count)
+        }
+        if skipped, ok := row[4].(int64); ok {
+            checkpoint.Skipped = int(skipped)
+        }
+        if shortValues := stringValue(row[5]); shortValues != "" {
+            if err := json.Unmarshal([]byte(shortValues), &checkpoint.ShortValues); err != nil {
+                return nil, fmt.Errorf("error decoding short value counts of column %s: %v", checkpoint.Column, err)
+            }
+        }
+        if updatedAt, ok := row[6].(time.Time); ok {
+            checkpoint.UpdatedAt = updatedAt
+        }
+        result[checkpoint.Column] = checkpoint
+    }
+    return result, nil
+}
+
+func (s *bigQueryCheckpointStore) Save(ctx context.Context, runKey string, checkpoint *columnCheckpoint) error {
+    shortValues, err := json.Marshal(checkpoint.ShortValues)
+    if err != nil {
+        return fmt.Errorf("error encoding short value counts: %v", err)
+    }
+
+    query := fmt.Sprintf(`
+MERGE %s AS target
+USING (SELECT @run_key AS run_key, @column_name AS column_name) AS source
+ON target.run_key = source.run_key AND target.column_name = source.column_name
+WHEN MATCHED THEN UPDATE SET
+    phase = @phase, cursor = @cursor, value_count = @value_count, skipped_count = @skipped_count,
+    short_values = @short_values, updated_at = @updated_at
+WHEN NOT MATCHED THEN INSERT (run_key, column_name, phase, cursor, value_count, skipped_count, short_values, updated_at)
+    VALUES (@run_key, @column_name, @phase, @cursor, @value_count, @skipped_count, @short_values, @updated_at)`, s.table.sql())
+
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "run_key", Value: runKey},
+        {Name: "column_name", Value: checkpoint.Column},
+        {Name: "phase", Value: checkpoint.Phase},
+        {Name: "cursor", Value: checkpoint.Cursor},
+        {Name: "value_count", Value: int64(checkpoint.Count)},
+        {Name: "skipped_count", Value: int64(checkpoint.Skipped)},
+        {Name: "short_values", Value: string(shortValues)},
+        {Name: "updated_at", Value: checkpoint.UpdatedAt},
+    })
+}
+
+func (s *bigQueryCheckpointStore) Clear(ctx context.Context, runKey string) error {
+    query := fmt.Sprintf(`DELETE FROM %s WHERE run_key = @run_key AND column_name != @lease_column`, s.table.sql())
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "run_key", Value: runKey},
+        {Name: "lease_column", Value: leaseColumn},
+    })
+}
+
+// Acquire inserts the run's lease row unless one exists, then reads back its owner. BigQuery
+// runs conflicting MERGE statements on a table one after the other or fails one of them, so two
+// owners can't both insert the row.
+func (s *bigQueryCheckpointStore) Acquire(ctx context.Context, runKey string, owner string, at time.Time) (bool, error) {
+    query := fmt.Sprintf(`
+MERGE %s AS target
+USING (SELECT @run_key AS run_key, @lease_column AS column_name) AS source
+ON target.run_key = source.run_key AND target.column_name = source.column_name
+WHEN MATCHED AND target.cursor = @owner THEN UPDATE SET updated_at = @updated_at
+WHEN NOT MATCHED THEN INSERT (run_key, column_name, phase, cursor, updated_at)
+    VALUES (@run_key, @lease_column, @phase, @owner, @updated_at)`, s.table.sql())
+    err := executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "run_key", Value: runKey},
+        {Name: "lease_column", Value: leaseColumn},
+        {Name: "owner", Value: owner},
+        {Name: "phase", Value: PhaseLease},
+        {Name: "updated_at", Value: at},
+    })
+    if err != nil {
+        return false, fmt.Errorf("error taking lease: %w", err)
+    }
+
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return false, err
+    }
+    defer bq.Close()
+    rows, err := bq.Query(ctx, fmt.Sprintf(`
+SELECT cursor
+FROM %s
+WHERE run_key = @run_key AND column_name = @lease_column`, s.table.sql()),
+        bigquery.QueryParameter{Name: "run_key", Value: runKey},
+        bigquery.QueryParameter{Name: "lease_column", Value: leaseColumn})
+    if err != nil {
+        return false, fmt.Errorf("error reading lease: %w", err)
+    }
+    return len(rows) == 1 && stringValue(rows[0][0]) == owner, nil
+}
+
+func (s *bigQueryCheckpointStore) Release(ctx context.Context, runKey string, owner string) error {
+    query := fmt.Sprintf(`
+DELETE FROM %s
+WHERE run_key = @run_key AND column_name = @lease_column AND cursor = @owner`, s.table.sql())
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "run_key", Value: runKey},
+        {Name: "lease_column", Value: leaseColumn},
+        {Name: "owner", Value: owner},
+    })
+}
+
+func (s *bigQueryCheckpointStore) Heartbeat(ctx context.Context, runKeys []string, owner string, at time.Time) error {
+    query := fmt.Sprintf(`
+UPDATE %s
+SET updated_at = @updated_at
+WHERE run_key IN UNNEST(@run_keys) AND column_name = @lease_column AND cursor = @owner`, s.table.sql())
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "updated_at", Value: at},
+        {Name: "run_keys", Value: runKeys},
+        {Name: "lease_column", Value: leaseColumn},
+        {Name: "owner", Value: owner},
+    })
+}
+
+func (s *bigQueryCheckpointStore) ExpireLeases(ctx context.Context, before time.Time) error {
+    query := fmt.Sprintf(`
+DELETE FROM %s
+WHERE column_name = @lease_column AND updated_at < @before`, s.table.sql())
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "lease_column", Value: leaseColumn},
+        {Name: "before", Value: before},
+    })
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestMemoryCheckpointStoreLease(t *testing.T) {
+    ctx := context.Background()
+    store := newMemoryCheckpointStore()
+    start := time.Now().UTC()
+
+    acquire := func(owner string, at time.Time, want bool) {
+        t.Helper()
+        got, err := store.Acquire(ctx, "run", owner, at)
+        if err != nil {
+            t.Fatalf("Acquire(%s) error: %v", owner, err)
+        }
+        if got != want {
+            t.Errorf("Acquire(%s) = %t, want %t", owner, got, want)
+        }
+    }
+
+    acquire("a", start, true)
+    acquire("a", start, true)
+    acquire("b", start, false)
+
+    // Clearing checkpoints keeps the lease, and a heartbeat keeps it from expiring
+    store.Clear(ctx, "run")
+    store.Heartbeat(ctx, []string{"run"}, "a", start.Add(2*time.Minute))
+    store.ExpireLeases(ctx, start.Add(time.Minute))
+    acquire("b", start, false)
+
+    // Another owner can't release or renew the lease
+    store.Release(ctx, "run", "b")
+    store.Heartbeat(ctx, []string{"run"}, "b", start.Add(time.Hour))
+    acquire("b", start, false)
+
+    store.ExpireLeases(ctx, start.Add(3*time.Minute))
+    acquire("b", start.Add(3*time.Minute), true)
+
+    store.Release(ctx, "run", "b")
+    acquire("a", start, true)
+}
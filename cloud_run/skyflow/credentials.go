@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+// credentialSet holds the Skyflow service account keys in use. After a rotation the previous key
+// stays usable for an overlap window, in case the new key isn't accepted by Skyflow yet.
+type credentialSet struct {
+    version       string // Secret Manager version of the active key
+    active        *SkyflowCredentials
+    previous      *SkyflowCredentials
+    previousUntil time.Time
+}
+
+var (
+    credentialsMutex sync.RWMutex
+    credentials      *credentialSet
+)
+
+// getCredentials returns the Skyflow keys to sign token requests with, preferred first: the
+// active key, then the previous key during the overlap window after a rotation. Keys outside
+// their validity window are left out. Credentials are loaded from Secret Manager on first use.
+func getCredentials() ([]*SkyflowCredentials, error) {
+    credentialsMutex.RLock()
+    set := credentials
+    credentialsMutex.RUnlock()
+    if set == nil {
+        if err := reloadCredentials(context.Background()); err != nil {
+            return nil, err
+        }
+        credentialsMutex.RLock()
+        set = credentials
+        credentialsMutex.RUnlock()
+    }
+
+    now := time.Now()
+    keys := make([]*SkyflowCredentials, 0, 2)
+    var invalid error
+    if err := set.active.validAt(now); err != nil {
+        invalid = err
+    } else {
+        keys = append(keys, set.active)
+    }
+    if set.previous != nil && now.Before(set.previousUntil) {
+        if err := set.previous.validAt(now); err == nil {
+            keys = append(keys, set.previous)
+        }
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("no valid Skyflow service account key: %v", invalid)
+    }
+    return keys, nil
+}
+
+// reloadCredentials loads the latest version of the credentials secret. When the version
+// changed, the new key becomes active and the old one is kept for CREDENTIALS_OVERLAP_SECONDS.
+func reloadCredentials(ctx context.Context) error {
+    sm, err := newSecretManager()
+    if err != nil {
+        return err
+    }
+    defer sm.Close()
+
+    data, version, err := sm.getSecretVersion(ctx, "credentials")
+    if err != nil {
+        return err
+    }
+
+    credentialsMutex.Lock()
+    defer credentialsMutex.Unlock()
+    if credentials != nil && credentials.version == version {
+        return nil
+    }
+
+    var creds SkyflowCredentials
+    if err := json.Unmarshal(data, &creds); err != nil {
+        return fmt.Errorf("failed to unmarshal credentials: %v", err)
+    }
+    if _, _, err := creds.validity(); err != nil {
+        return err
+    }
+
+    set := &credentialSet{version: version, active: &creds}
+    if credentials != nil {
+        overlap := time.Duration(getBatchSize("CREDENTIALS_OVERLAP_SECONDS", 3600)) * time.Second
+        set.previous = credentials.active
+        set.previousUntil = time.Now().Add(overlap)
+        log.Printf("[INFO] Skyflow credentials rotated to secret version %s (key %s); previous key %s is accepted until %s",
+            version, creds.KeyID, credentials.active.KeyID, set.previousUntil.Format(time.RFC3339))
+    } else {
+        log.Printf("[INFO] Loaded Skyflow credentials from secret version %s (key %s)", version, creds.KeyID)
+    }
+    credentials = set
+    return nil
+}
+
+// startCredentialRotation polls the credentials secret every CREDENTIALS_POLL_SECONDS so a
+// rotated key is picked up without a redeploy, and warns when the active key is about to expire
+func startCredentialRotation() {
+    interval := time.Duration(getBatchSize("CREDENTIALS_POLL_SECONDS", 300)) * time.Second
+    warning := time.Duration(getBatchSize("CREDENTIALS_EXPIRY_WARNING_DAYS", 14)) * 24 * time.Hour
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            if err := reloadCredentials(context.Background()); err != nil {
+                log.Printf("[ERROR] Failed to reload Skyflow credentials: %v", err)
+            }
+            warnExpiringCredentials(warning)
+            <-ticker.C
+        }
+    }()
+}
+
+// warnExpiringCredentials logs a warning when the active key expires within the given time
+func warnExpiringCredentials(within time.Duration) {
+    credentialsMutex.RLock()
+    set := credentials
+    credentialsMutex.RUnlock()
+    if set == nil {
+        return
+    }
+    _, validBefore, _ := set.active.validity()
+    if validBefore.IsZero() {
+        return
+    }
+    if remaining := time.Until(validBefore); remaining < within {
+        log.Printf("[WARN] Skyflow service account key %s expires at %s (in %v), rotate the %s_credentials secret",
+            set.active.KeyID, validBefore.Format(time.RFC3339), remaining.Round(time.Hour), os.Getenv("PREFIX"))
+    }
+}
+
+// validity returns the key's validity window. Unset bounds are zero.
+func (c *SkyflowCredentials) validity() (time.Time, time.Time, error) {
+    var validAfter, validBefore time.Time
+    var err error
+    if c.KeyValidAfterTime != "" {
+        if validAfter, err = time.Parse(time.RFC3339, c.KeyValidAfterTime); err != nil {
+            return validAfter, validBefore, fmt.Errorf("invalid keyValidAfterTime %q in credentials: %v", c.KeyValidAfterTime, err)
+        }
+    }
+    if c.KeyValidBeforeTime != "" {
+        if validBefore, err = time.Parse(time.RFC3339, c.KeyValidBeforeTime); err != nil {
+            return validAfter, validBefore, fmt.Errorf("invalid keyValidBeforeTime %q in credentials: %v", c.KeyValidBeforeTime, err)
+        }
+    }
+    return validAfter, validBefore, nil
+}
+
+// validAt checks that the key may be used at the given time
+func (c *SkyflowCredentials) validAt(t time.Time) error {
+    validAfter, validBefore, err := c.validity()
+    if err != nil {
+        return err
+    }
+    if !validAfter.IsZero() && t.Before(validAfter) {
+        return fmt.Errorf("key %s is not valid before %s", c.KeyID, validAfter.Format(time.RFC3339))
+    }
+    if !validBefore.IsZero() && !t.Before(validBefore) {
+        return fmt.Errorf("key %s expired at %s", c.KeyID, validBefore.Format(time.RFC3339))
+    }
+    return nil
+}
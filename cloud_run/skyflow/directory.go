@@ -0,0 +1,217 @@
+package main
+
+import (
+    cloudidentity "google.golang.org/api/cloudidentity/v1"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Group directories, selected with GROUP_DIRECTORY
+const (
+    DirectoryCloudIdentity = "cloudidentity" // Look up memberships in Cloud Identity
+    DirectoryStatic        = "static"        // Read memberships from GROUP_DIRECTORY_FILE
+    DirectoryNone          = "none"          // Identities belong to no group
+)
+
+// groupDirectory resolves the Google groups an identity belongs to, so roles granted to a group
+// apply to its members
+type groupDirectory interface {
+    // groupsOf returns the emails of the groups the identity is a member of, directly or through
+    // nested groups
+    groupsOf(ctx context.Context, email string) ([]string, error)
+}
+
+var (
+    directoryOnce sync.Once
+    directory     groupDirectory
+)
+
+// getGroupDirectory returns the configured group directory. Memberships are cached for
+// GROUP_CACHE_TTL_SECONDS.
+func getGroupDirectory() groupDirectory {
+    directoryOnce.Do(func() {
+        mode := strings.ToLower(os.Getenv("GROUP_DIRECTORY"))
+        var source groupDirectory
+        switch mode {
+        case DirectoryCloudIdentity:
+            source = &cloudIdentityDirectory{}
+        case DirectoryStatic:
+            static, err := loadStaticDirectory(os.Getenv("GROUP_DIRECTORY_FILE"))
+            if err != nil {
+                log.Fatalf("[FATAL] GROUP_DIRECTORY is static but GROUP_DIRECTORY_FILE can't be loaded: %v", err)
+            }
+            source = static
+        case "", DirectoryNone:
+            source = staticDirectory{}
+            mode = DirectoryNone
+        default:
+            log.Fatalf("[FATAL] Unknown GROUP_DIRECTORY: %s", mode)
+        }
+        directory = &cachedDirectory{
+            source:  source,
+            ttl:     time.Duration(getBatchSize("GROUP_CACHE_TTL_SECONDS", 300)) * time.Second,
+            entries: make(map[string]groupCacheEntry),
+        }
+        log.Printf("[INFO] Using %s group directory", mode)
+    })
+    return directory
+}
+
+// cloudIdentityDirectory looks up transitive group memberships with the Cloud Identity API. The
+// service account needs the Groups Reader admin role, which google_cloud_ops.sh assigns.
+type cloudIdentityDirectory struct {
+    once    sync.Once
+    service *cloudidentity.Service
+    err     error
+}
+
+func (d *cloudIdentityDirectory) groupsOf(ctx context.Context, email string) ([]string, error) {
+    d.once.Do(func() {
+        d.service, d.err = cloudidentity.NewService(context.Background())
+    })
+    if d.err != nil {
+        return nil, fmt.Errorf("failed to create Cloud Identity client: %v", d.err)
+    }
+
+    query := fmt.Sprintf("member_key_id == '%s' && 'cloudidentity.googleapis.com/groups.discussion_forum' in labels",
+        strings.ReplaceAll(email, "'", "\\'"))
+    var groups []string
+    err := d.service.Groups.Memberships.SearchTransitiveGroups("groups/-").Query(query).Pages(ctx,
+        func(page *cloudidentity.SearchTransitiveGroupsResponse) error {
+            for _, membership := range page.Memberships {
+                if membership.GroupKey != nil && membership.GroupKey.Id != "" {
+                    groups = append(groups, strings.ToLower(membership.GroupKey.Id))
+                }
+            }
+            return nil
+        })
+    if err != nil {
+        return nil, fmt.Errorf("failed to search groups of %s: %v", email, err)
+    }
+    return groups, nil
+}
+
+// staticDirectory holds the members of each group, keyed by group email. A member that is itself
+// a group brings in that group's members.
+type staticDirectory map[string][]string
+
+// loadStaticDirectory reads a JSON file mapping group emails to member emails:
+// {"analysts@example.com": ["alice@example.com", "leads@example.com"]}
+func loadStaticDirectory(path string) (staticDirectory, error) {
+    if path == "" {
+        return nil, fmt.Errorf("GROUP_DIRECTORY_FILE is not set")
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var groups map[string][]string
+    if err := json.Unmarshal(data, &groups); err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    directory := make(staticDirectory, len(groups))
+    for group, members := range groups {
+        key := strings.ToLower(group)
+        for _, member := range members {
+            directory[key] = append(directory[key], strings.ToLower(member))
+        }
+    }
+    return directory, nil
+}
+
+func (d staticDirectory) groupsOf(ctx context.Context, email string) ([]string, error) {
+    // Walk up from the identity through the groups containing it
+    found := make(map[string]bool)
+    pending := []string{strings.ToLower(email)}
+    for len(pending) > 0 {
+        member := pending[0]
+        pending = pending[1:]
+        for group, members := range d {
+            if found[group] {
+                continue
+            }
+            for _, m := range members {
+                if m == member {
+                    found[group] = true
+                    pending = append(pending, group)
+                    break
+                }
+            }
+        }
+    }
+    groups := make([]string, 0, len(found))
+    for group := range found {
+        groups = append(groups, group)
+    }
+    return groups, nil
+}
+
+// groupCacheEntry holds the groups of an identity until it expires
+type groupCacheEntry struct {
+    groups    []string
+    expiresAt time.Time
+}
+
+// cachedDirectory caches the groups of each identity for ttl. Failed lookups aren't cached.
+type cachedDirectory struct {
+    sync.Mutex
+    source  groupDirectory
+    ttl     time.Duration
+    entries map[string]groupCacheEntry
+}
+
+func (d *cachedDirectory) groupsOf(ctx context.Context, email string) ([]string, error) {
+    key := strings.ToLower(email)
+    d.Lock()
+    entry, ok := d.entries[key]
+    d.Unlock()
+    if ok && time.Now().Before(entry.expiresAt) {
+        return entry.groups, nil
+    }
+
+    groups, err := d.source.groupsOf(ctx, email)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("[DEBUG] Groups of %s: %v", email, groups)
+
+    d.Lock()
+    defer d.Unlock()
+    now := time.Now()
+    for cached, entry := range d.entries {
+        if now.After(entry.expiresAt) {
+            delete(d.entries, cached)
+        }
+    }
+    d.entries[key] = groupCacheEntry{groups: groups, expiresAt: now.Add(d.ttl)}
+    return groups, nil
+}
+
+// identityMembers returns the IAM members, in lower case, that an identity matches: itself as a
+// user or service account, its email domain and, if withGroups is set, the groups it belongs to
+func identityMembers(ctx context.Context, email string, withGroups bool) (map[string]bool, error) {
+    email = strings.ToLower(email)
+    members := map[string]bool{
+        "user:" + email:           true,
+        "serviceaccount:" + email: true,
+    }
+    if at := strings.LastIndex(email, "@"); at >= 0 {
+        members["domain:"+email[at+1:]] = true
+    }
+    if withGroups {
+        groups, err := getGroupDirectory().groupsOf(ctx, email)
+        if err != nil {
+            return nil, err
+        }
+        for _, group := range groups {
+            members["group:"+strings.ToLower(group)] = true
+        }
+    }
+    return members, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestStaticDirectoryGroupsOf(t *testing.T) {
+    // leads is nested in analysts, and admins and ops contain each other
+    directory := staticDirectory{
+        "analysts@example.com": {"alice@example.com", "leads@example.com"},
+        "leads@example.com":    {"bob@example.com"},
+        "admins@example.com":   {"carol@example.com", "ops@example.com"},
+        "ops@example.com":      {"admins@example.com"},
+    }
+    tests := []struct {
+        email string
+        want  []string
+    }{
+        {email: "alice@example.com", want: []string{"analysts@example.com"}},
+        {email: "Bob@Example.com", want: []string{"analysts@example.com", "leads@example.com"}},
+        {email: "carol@example.com", want: []string{"admins@example.com", "ops@example.com"}},
+        {email: "dave@example.com", want: []string{}},
+    }
+    for _, tt := range tests {
+        got, err := directory.groupsOf(context.Background(), tt.email)
+        if err != nil {
+            t.Errorf("groupsOf(%q) error: %v", tt.email, err)
+            continue
+        }
+        sort.Strings(got)
+        if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+            t.Errorf("groupsOf(%q) = %v, want %v", tt.email, got, tt.want)
+        }
+    }
+}
+
+func TestGrantedRoles(t *testing.T) {
+    directoryOnce.Do(func() {})
+    directory = &cachedDirectory{
+        source:  staticDirectory{"analysts@example.com": {"alice@example.com"}},
+        ttl:     time.Minute,
+        entries: make(map[string]groupCacheEntry),
+    }
+
+    bindings := []iamBinding{
+        {Resource: "projects/p", Role: "roles/user", Members: []string{"user:Alice@example.com"}},
+        {Resource: "projects/p", Role: "roles/group", Members: []string{"group:analysts@example.com"}},
+        {Resource: "folders/1", Role: "roles/domain", Members: []string{"domain:example.com"}},
+        {Resource: "organizations/2", Role: "roles/sa", Members: []string{"serviceAccount:job@p.iam.gserviceaccount.com"}},
+        {Resource: "projects/p", Role: "roles/other", Members: []string{"user:bob@example.com", "group:admins@example.com", "domain:other.com"}},
+        {Resource: "folders/1", Role: "roles/user", Members: []string{"user:alice@example.com"}},
+    }
+    tests := []struct {
+        email      string
+        withGroups bool
+        want       []string
+    }{
+        {email: "alice@example.com", withGroups: true, want: []string{"roles/user", "roles/group", "roles/domain"}},
+        {email: "alice@example.com", want: []string{"roles/user", "roles/domain"}},
+        {email: "carol@example.com", withGroups: true, want: []string{"roles/domain"}},
+        {email: "job@p.iam.gserviceaccount.com", withGroups: true, want: []string{"roles/sa"}},
+        {email: "dave@elsewhere.com", withGroups: true, want: []string{}},
+    }
+    for _, tt := range tests {
+        identities, err := identityMembers(context.Background(), tt.email, tt.withGroups)
+        if err != nil {
+            t.Errorf("identityMembers(%q) error: %v", tt.email, err)
+            continue
+        }
+        got := grantedRoles(bindings, identities)
+        if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+            t.Errorf("grantedRoles for %s (groups %t) = %v, want %v", tt.email, tt.withGroups, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "os"
+    "regexp"
+    "strings"
+)
+
+// Default Skyflow field holding values of unmapped columns
+const defaultSkyflowField = "pii"
+
+// Skyflow table and field names
+var skyflowNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,127}$`)
+
+// ColumnMapping maps a BigQuery column to the Skyflow table and field its values are stored in,
+// and sets how the column's short values are treated
+type ColumnMapping struct {
+    Table            string `json:"table,omitempty"`            // Fully qualified BigQuery table; the mapping applies to every table if empty
+    Column           string `json:"column"`                     // BigQuery column path, such as email or contact.email
+    SkyflowTable     string `json:"skyflowTable,omitempty"`     // Skyflow table; SKYFLOW_TABLE_NAME if empty
+    SkyflowField     string `json:"skyflowField,omitempty"`     // Skyflow field; the pii field if empty
+    MinLength        int    `json:"minLength,omitempty"`        // Values shorter than this are short values; MIN_VALUE_LENGTH if 0
+    ShortValuePolicy string `json:"shortValuePolicy,omitempty"` // Treatment of short values; SHORT_VALUE_POLICY if empty
+    RedactionMarker  string `json:"redactionMarker,omitempty"`  // Replacement for short values under the redact policy
+    Upsert           bool   `json:"upsert,omitempty"`           // Upsert on the Skyflow field, which must be unique, so identical values share a token
+}
+
+// skyflowField identifies a field of a Skyflow vault table
+type skyflowField struct {
+    Table string
+    Field string
+}
+
+// String returns the field as table.field
+func (f skyflowField) String() string {
+    return f.Table + "." + f.Field
+}
+
+// defaultField returns the Skyflow field used for unmapped columns
+func defaultField() skyflowField {
+    return skyflowField{Table: os.Getenv("SKYFLOW_TABLE_NAME"), Field: defaultSkyflowField}
+}
+
+// columnMappingFor returns the mapping of a column of a table, or nil if the column is unmapped.
+// Mappings for the table take precedence over mappings for every table.
+func columnMappingFor(table tableRef, column string) *ColumnMapping {
+    var match *ColumnMapping
+    mappings := getRoleConfig().ColumnMappings
+    for i, mapping := range mappings {
+        path, err := parseColumnPath(mapping.Column)
+        if err != nil || !strings.EqualFold(path.String(), column) {
+            continue
+        }
+        if mapping.Table == "" {
+            if match == nil {
+                match = &mappings[i]
+            }
+            continue
+        }
+        if mappedTable, err := parseTableName(mapping.Table); err == nil && mappedTable == table {
+            return &mappings[i]
+        }
+    }
+    return match
+}
+
+// skyflowFieldFor returns the Skyflow field mapped to a column of a table. Unmapped columns use
+// the default field.
+func skyflowFieldFor(table tableRef, column string) skyflowField {
+    mapping := columnMappingFor(table, column)
+    if mapping == nil {
+        return defaultField()
+    }
+    return mapping.skyflowField()
+}
+
+// skyflowField returns the Skyflow field of a mapping, filling in defaults
+func (m *ColumnMapping) skyflowField() skyflowField {
+    field := skyflowField{Table: m.SkyflowTable, Field: m.SkyflowField}
+    if field.Table == "" {
+        field.Table = os.Getenv("SKYFLOW_TABLE_NAME")
+    }
+    if field.Field == "" {
+        field.Field = defaultSkyflowField
+    }
+    return field
+}
+
+// isUpsertField reports whether values of a Skyflow field are upserted, keyed on the field
+// itself, instead of inserted as new records. Set by any column mapping to the field, so
+// tokenize_value returns the tokens tokenize_table stored.
+func isUpsertField(field skyflowField) bool {
+    for _, mapping := range getRoleConfig().ColumnMappings {
+        if mapping.Upsert && mapping.skyflowField() == field {
+            return true
+        }
+    }
+    return false
+}
+
+// groupColumns splits the columns of a tokenize run into the groups tokenized together. Top-level
+// columns mapped to different fields of the same Skyflow table share a group, so the values of a
+// row go into one Skyflow record. Nested paths, which hold any number of values per row, columns
+// of upsert fields, which are keyed on their own field, and columns mapped to a field already in
+// the group are tokenized on their own.
+func groupColumns(table tableRef, columns []string) [][]string {
+    groups := make([][]string, 0, len(columns))
+    shared := make(map[string]int)              // Skyflow table -> index of its shared group
+    groupFields := make(map[int]map[string]bool) // Fields filled by each shared group
+    for _, column := range columns {
+        field := skyflowFieldFor(table, column)
+        path, err := parseColumnPath(column)
+        if err != nil || !path.isColumn() || isUpsertField(field) {
+            groups = append(groups, []string{column})
+            continue
+        }
+        i, ok := shared[field.Table]
+        if !ok {
+            i = len(groups)
+            shared[field.Table] = i
+            groupFields[i] = make(map[string]bool)
+            groups = append(groups, nil)
+        }
+        if groupFields[i][field.Field] {
+            groups = append(groups, []string{column})
+            continue
+        }
+        groupFields[i][field.Field] = true
+        groups[i] = append(groups[i], column)
+    }
+    return groups
+}
+
+// parseSkyflowField parses a Skyflow field given as field or table.field. An empty name is the
+// default field.
+func parseSkyflowField(name string) (skyflowField, error) {
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return defaultField(), nil
+    }
+
+    field := skyflowField{Table: os.Getenv("SKYFLOW_TABLE_NAME"), Field: name}
+    if table, fieldName, qualified := strings.Cut(name, "."); qualified {
+        field = skyflowField{Table: table, Field: fieldName}
+    }
+    if !skyflowNamePattern.MatchString(field.Table) || !skyflowNamePattern.MatchString(field.Field) {
+        return skyflowField{}, badRequest("invalid Skyflow field %q: expected field or table.field", name)
+    }
+    return field, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "fmt"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// rowFilter restricts a tokenize_table run to part of a table. Every set condition must hold.
+type rowFilter struct {
+    Predicate       string             `json:"predicate,omitempty"`        // Validated boolean SQL expression over the table's columns
+    Partition       string             `json:"partition,omitempty"`        // Partition ID, as in a table$partition decorator
+    PartitionColumn string             `json:"partition_column,omitempty"` // Partitioning column, _PARTITIONTIME for ingestion-time partitioning
+    PartitionType   bigquery.FieldType `json:"partition_type,omitempty"`
+    PartitionStart  string             `json:"partition_start,omitempty"` // Inclusive lower bound of the partition
+    PartitionEnd    string             `json:"partition_end,omitempty"`   // Exclusive upper bound of the partition
+    WatermarkColumn string             `json:"watermark_column,omitempty"` // Only rows past the previous run's watermark are read
+    WatermarkType   bigquery.FieldType `json:"watermark_type,omitempty"`
+}
+
+// rowCondition is a resolved rowFilter: a SQL condition and the parameters it uses
+type rowCondition struct {
+    sql    string
+    params []bigquery.QueryParameter
+}
+
+// where returns the condition prefixed with AND, or an empty string if there is no condition
+func (c *rowCondition) where() string {
+    if c == nil || c.sql == "" {
+        return ""
+    }
+    return " AND " + c.sql
+}
+
+// parameters returns the condition's query parameters
+func (c *rowCondition) parameters() []bigquery.QueryParameter {
+    if c == nil {
+        return nil
+    }
+    return c.params
+}
+
+// Partition ID layouts by partitioning granularity
+var partitionLayouts = map[bigquery.TimePartitioningType]string{
+    bigquery.HourPartitioningType:  "2006010215",
+    bigquery.DayPartitioningType:   "20060102",
+    bigquery.MonthPartitioningType: "200601",
+    bigquery.YearPartitioningType:  "2006",
+}
+
+// Column types usable as a watermark
+var watermarkTypes = map[bigquery.FieldType]bool{
+    bigquery.TimestampFieldType: true,
+    bigquery.DateTimeFieldType:  true,
+    bigquery.DateFieldType:      true,
+    bigquery.IntegerFieldType:   true,
+    bigquery.NumericFieldType:   true,
+}
+
+// parseRowFilter builds the row filter configured in the user defined context. Returns nil if no
+// filter is configured.
+func parseRowFilter(userContext UserDefinedContext, table tableRef, metadata *bigquery.TableMetadata) (*rowFilter, error) {
+    if userContext.Filter == "" && userContext.Partition == "" && userContext.WatermarkColumn == "" {
+        return nil, nil
+    }
+
+    filter := &rowFilter{}
+    if userContext.Filter != "" {
+        if err := validatePredicate(userContext.Filter); err != nil {
+            return nil, err
+        }
+        filter.Predicate = strings.TrimSpace(userContext.Filter)
+    }
+
+    if userContext.Partition != "" {
+        if err := filter.setPartition(userContext.Partition, table, metadata); err != nil {
+            return nil, err
+        }
+    }
+
+    if userContext.WatermarkColumn != "" {
+        name, err := parseColumnName(userContext.WatermarkColumn)
+        if err != nil {
+            return nil, err
+        }
+        field := findField(metadata.Schema, name)
+        if field == nil {
+            return nil, badRequest("watermark column %q does not exist in table %s", name, table)
+        }
+        if !watermarkTypes[field.Type] || field.Repeated {
+            return nil, badRequest("watermark column %q in table %s has type %s, expected a timestamp, date or number", name, table, fieldTypeName(field))
+        }
+        filter.WatermarkColumn = field.Name
+        filter.WatermarkType = field.Type
+    }
+
+    return filter, nil
+}
+
+// setPartition restricts the filter to one partition of a time-partitioned table. The partition
+// is expressed as a range on the partitioning column so BigQuery prunes the other partitions.
+func (f *rowFilter) setPartition(partition string, table tableRef, metadata *bigquery.TableMetadata) error {
+    partitioning := metadata.TimePartitioning
+    if partitioning == nil {
+        return badRequest("table %s is not time-partitioned", table)
+    }
+    layout, ok := partitionLayouts[partitioning.Type]
+    if !ok {
+        return badRequest("unsupported partitioning type %s of table %s", partitioning.Type, table)
+    }
+    start, err := time.Parse(layout, partition)
+    if err != nil {
+        return badRequest("invalid partition %q for %s partitioned table %s", partition, partitioning.Type, table)
+    }
+
+    var end time.Time
+    switch partitioning.Type {
+    case bigquery.HourPartitioningType:
+        end = start.Add(time.Hour)
+    case bigquery.DayPartitioningType:
+        end = start.AddDate(0, 0, 1)
+    case bigquery.MonthPartitioningType:
+        end = start.AddDate(0, 1, 0)
+    case bigquery.YearPartitioningType:
+        end = start.AddDate(1, 0, 0)
+    }
+
+    f.Partition = partition
+    f.PartitionColumn = "_PARTITIONTIME"
+    f.PartitionType = bigquery.TimestampFieldType
+    if partitioning.Field != "" {
+        field := findField(metadata.Schema, partitioning.Field)
+        if field == nil {
+            return fmt.Errorf("partitioning column %s not found in table %s", partitioning.Field, table)
+        }
+        f.PartitionColumn = field.Name
+        f.PartitionType = field.Type
+    }
+
+    layout = "2006-01-02 15:04:05"
+    if f.PartitionType == bigquery.DateFieldType {
+        layout = "2006-01-02"
+    }
+    f.PartitionStart = start.Format(layout)
+    f.PartitionEnd = end.Format(layout)
+    return nil
+}
+
+// condition resolves the filter to a SQL condition. low and high bound the watermark column;
+// rows above low (if set) and up to high are selected.
+func (f *rowFilter) condition(low string, high string) *rowCondition {
+    if f == nil {
+        return nil
+    }
+
+    conditions := make([]string, 0, 3)
+    params := make([]bigquery.QueryParameter, 0, 4)
+    if f.Predicate != "" {
+        conditions = append(conditions, "("+f.Predicate+")")
+    }
+    if f.Partition != "" {
+        column := quoteIdentifier(f.PartitionColumn)
+        if f.PartitionColumn == "_PARTITIONTIME" {
+            column = f.PartitionColumn
+        }
+        conditions = append(conditions, fmt.Sprintf("%s >= CAST(@partition_start AS %s) AND %s < CAST(@partition_end AS %s)",
+            column, f.PartitionType, column, f.PartitionType))
+        params = append(params,
+            bigquery.QueryParameter{Name: "partition_start", Value: f.PartitionStart},
+            bigquery.QueryParameter{Name: "partition_end", Value: f.PartitionEnd})
+    }
+    if f.WatermarkColumn != "" {
+        column := quoteIdentifier(f.WatermarkColumn)
+        if low != "" {
+            conditions = append(conditions, fmt.Sprintf("%s > CAST(@watermark_low AS %s)", column, f.WatermarkType))
+            params = append(params, bigquery.QueryParameter{Name: "watermark_low", Value: low})
+        }
+        conditions = append(conditions, fmt.Sprintf("%s <= CAST(@watermark_high AS %s)", column, f.WatermarkType))
+        params = append(params, bigquery.QueryParameter{Name: "watermark_high", Value: high})
+    }
+
+    return &rowCondition{sql: strings.Join(conditions, " AND "), params: params}
+}
+
+// Maximum length of a filter predicate
+const maxPredicateLength = 1024
+
+// Keywords that could turn a predicate into a separate statement or a read of other tables
+var unsafePredicateKeyword = regexp.MustCompile(`(?i)\b(SELECT|FROM|WITH|UNION|INTERSECT|EXCEPT|INSERT|UPDATE|DELETE|MERGE|TRUNCATE|CREATE|DROP|ALTER|GRANT|REVOKE|EXECUTE|EXPORT|LOAD|CALL|DECLARE|SET|BEGIN|COMMIT|ROLLBACK|ASSERT)\b`)
+
+// validatePredicate checks that a filter predicate is a single expression over the table's own
+// columns. Statement separators, comments, query parameters, subqueries and DML/DDL keywords are
+// rejected outside string literals, and parentheses and quotes must balance so the predicate
+// can't escape the parentheses it is wrapped in. Backslashes and triple-quoted strings are
+// rejected so string literals always end at the next matching quote.
+func validatePredicate(predicate string) error {
+    if len(predicate) > maxPredicateLength {
+        return badRequest("filter is longer than %d characters", maxPredicateLength)
+    }
+    if strings.Contains(predicate, "\\") {
+        return badRequest("filter may not contain backslashes")
+    }
+    if strings.Contains(predicate, "'''") || strings.Contains(predicate, `"""`) {
+        return badRequest("filter may not contain triple-quoted strings")
+    }
+
+    // Replace string literals with empty ones so only code is checked for keywords
+    var code strings.Builder
+    depth := 0
+    for i := 0; i < len(predicate); i++ {
+        c := predicate[i]
+        switch {
+        case c == '\'' || c == '"':
+            end := i + 1
+            for end < len(predicate) && predicate[end] != c {
+                end++
+            }
+            if end >= len(predicate) {
+                return badRequest("unterminated string in filter")
+            }
+            code.WriteString(" '' ")
+            i = end
+        case c == '`':
+            end := strings.IndexByte(predicate[i+1:], '`')
+            if end < 0 {
+                return badRequest("unterminated quoted identifier in filter")
+            }
+            if _, err := parseColumnName(predicate[i : i+end+2]); err != nil {
+                return err
+            }
+            code.WriteString(" col ")
+            i += end + 1
+        case c == ';' || c == '@' || c == '#':
+            return badRequest("filter may not contain %q", c)
+        case c == '-' && i+1 < len(predicate) && predicate[i+1] == '-',
+            c == '/' && i+1 < len(predicate) && predicate[i+1] == '*':
+            return badRequest("filter may not contain comments")
+        case c == '(':
+            depth++
+            code.WriteByte(c)
+        case c == ')':
+            depth--
+            if depth < 0 {
+                return badRequest("unbalanced parentheses in filter")
+            }
+            code.WriteByte(c)
+        default:
+            code.WriteByte(c)
+        }
+    }
+    if depth != 0 {
+        return badRequest("unbalanced parentheses in filter")
+    }
+    if keyword := unsafePredicateKeyword.FindString(code.String()); keyword != "" {
+        return badRequest("filter may not contain %s", strings.ToUpper(keyword))
+    }
+    return nil
+}
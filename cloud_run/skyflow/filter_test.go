@@ -0,0 +1,98 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "strings"
+    "testing"
+)
+
+func TestValidatePredicate(t *testing.T) {
+    tests := []struct {
+        predicate string
+        wantErr   bool
+    }{
+        {predicate: "country = 'US'"},
+        {predicate: "`first name` IS NOT NULL AND (a > 1 OR b < 2)"},
+        {predicate: "created_at > TIMESTAMP '2024-01-01'"},
+        {predicate: "note = 'select from; --'"},
+        {predicate: `name = "O'Brien"`},
+        {predicate: "`a;b` = 1"},
+        {predicate: "1=1; DROP TABLE x", wantErr: true},
+        {predicate: "a = 1 -- x", wantErr: true},
+        {predicate: "a /* c */ = 1", wantErr: true},
+        {predicate: "a = 1 # x", wantErr: true},
+        {predicate: "a IN (SELECT b FROM t)", wantErr: true},
+        {predicate: "a = 1 UNION ALL", wantErr: true},
+        {predicate: "a = 1) OR (1=1", wantErr: true},
+        {predicate: "(a = 1", wantErr: true},
+        {predicate: "a = @p", wantErr: true},
+        {predicate: "a = 'x", wantErr: true},
+        {predicate: "`a = 1", wantErr: true},
+        {predicate: "`a\tb` = 1", wantErr: true},
+        {predicate: "a = '\\' ; x'", wantErr: true},
+        {predicate: "a = '''x'''", wantErr: true},
+        {predicate: "a = 'x" + strings.Repeat("y", maxPredicateLength) + "'", wantErr: true},
+    }
+    for _, tt := range tests {
+        err := validatePredicate(tt.predicate)
+        if tt.wantErr && err == nil {
+            t.Errorf("validatePredicate(%q) accepted, want error", tt.predicate)
+        }
+        if !tt.wantErr && err != nil {
+            t.Errorf("validatePredicate(%q) error: %v", tt.predicate, err)
+        }
+    }
+}
+
+func TestRowFilterCondition(t *testing.T) {
+    filter := &rowFilter{
+        Predicate:       "country = 'US'",
+        Partition:       "20240101",
+        PartitionColumn: "_PARTITIONTIME",
+        PartitionType:   bigquery.TimestampFieldType,
+        PartitionStart:  "2024-01-01 00:00:00",
+        PartitionEnd:    "2024-01-02 00:00:00",
+        WatermarkColumn: "updated_at",
+        WatermarkType:   bigquery.TimestampFieldType,
+    }
+
+    tests := []struct {
+        low, high  string
+        wantSQL    string
+        wantParams []string
+    }{
+        {
+            low:        "",
+            high:       "2024-01-01 12:00:00",
+            wantSQL:    " AND (country = 'US') AND _PARTITIONTIME >= CAST(@partition_start AS TIMESTAMP) AND _PARTITIONTIME < CAST(@partition_end AS TIMESTAMP) AND `updated_at` <= CAST(@watermark_high AS TIMESTAMP)",
+            wantParams: []string{"partition_start", "partition_end", "watermark_high"},
+        },
+        {
+            low:        "2024-01-01 06:00:00",
+            high:       "2024-01-01 12:00:00",
+            wantSQL:    " AND (country = 'US') AND _PARTITIONTIME >= CAST(@partition_start AS TIMESTAMP) AND _PARTITIONTIME < CAST(@partition_end AS TIMESTAMP) AND `updated_at` > CAST(@watermark_low AS TIMESTAMP) AND `updated_at` <= CAST(@watermark_high AS TIMESTAMP)",
+            wantParams: []string{"partition_start", "partition_end", "watermark_low", "watermark_high"},
+        },
+    }
+    for _, tt := range tests {
+        condition := filter.condition(tt.low, tt.high)
+        if got := condition.where(); got != tt.wantSQL {
+            t.Errorf("condition(%q, %q).where() = %q, want %q", tt.low, tt.high, got, tt.wantSQL)
+        }
+        params := condition.parameters()
+        if len(params) != len(tt.wantParams) {
+            t.Errorf("condition(%q, %q) has %d parameters, want %d", tt.low, tt.high, len(params), len(tt.wantParams))
+            continue
+        }
+        for i, param := range params {
+            if param.Name != tt.wantParams[i] {
+                t.Errorf("condition(%q, %q) parameter %d = %s, want %s", tt.low, tt.high, i, param.Name, tt.wantParams[i])
+            }
+        }
+    }
+
+    var none *rowFilter
+    if got := none.condition("", "").where(); got != "" {
+        t.Errorf("nil filter where() = %q, want empty", got)
+    }
+}
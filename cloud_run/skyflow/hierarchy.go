@@ -0,0 +1,528 @@
+package main
+
+import (
+    cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+    cloudresourcemanagerv3 "google.golang.org/api/cloudresourcemanager/v3"
+    "google.golang.org/api/googleapi"
+    iam "google.golang.org/api/iam/v1"
+    iamv2 "google.golang.org/api/iam/v2"
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// iamResource is the project or one of its folders or its organization. IAM policies of all of
+// them apply to the project.
+type iamResource struct {
+    Type string // "project", "folder" or "organization"
+    ID   string
+}
+
+// String returns the resource name, e.g. folders/123
+func (r iamResource) String() string {
+    return r.Type + "s/" + r.ID
+}
+
+// iamBinding grants a role to members on a resource of the hierarchy
+type iamBinding struct {
+    Resource string
+    Role     string
+    Members  []string
+}
+
+// denyRule denies permissions to principals on a resource of the hierarchy, regardless of the
+// roles granted to them. Principals use IAM v2 identifiers, e.g. principal://goog/subject/EMAIL,
+// and permissions the SERVICE.googleapis.com/RESOURCE.VERB form.
+type denyRule struct {
+    Policy               string
+    DeniedPrincipals     []string
+    ExceptionPrincipals  []string
+    DeniedPermissions    []string
+    ExceptionPermissions []string
+}
+
+// Handling of folder and organization allow policies the service account may not read, selected
+// with IAM_UNREADABLE_ANCESTORS
+const (
+    UnreadableAncestorsFail = "fail" // Resolving roles fails
+    UnreadableAncestorsSkip = "skip" // Roles granted there are ignored, with a warning
+)
+
+// effectivePolicy merges the allow and deny policies of the project, its folders and its
+// organization
+type effectivePolicy struct {
+    Bindings  []iamBinding
+    DenyRules []denyRule
+}
+
+var (
+    // Ancestry of the project, cached for IAM_ANCESTRY_CACHE_SECONDS
+    ancestryCache struct {
+        sync.Mutex
+        projectID string
+        resources []iamResource
+        expiresAt time.Time
+    }
+    // Merged IAM policies, cached for IAM_POLICY_CACHE_SECONDS
+    policyCache struct {
+        sync.Mutex
+        projectID string
+        policy    *effectivePolicy
+        expiresAt time.Time
+    }
+    // Policy resolutions in progress
+    policyFetches sync.Map // project ID -> *policyFetch
+    // Permissions of IAM roles, cached for IAM_ANCESTRY_CACHE_SECONDS
+    rolePermissionsCache struct {
+        sync.Mutex
+        permissions map[string][]string
+        expiresAt   time.Time
+    }
+)
+
+// getAncestry returns the project followed by its folders, innermost first, and its organization
+func getAncestry(ctx context.Context, client *cloudresourcemanager.Service, projectID string) ([]iamResource, error) {
+    ancestryCache.Lock()
+    defer ancestryCache.Unlock()
+    if ancestryCache.projectID == projectID && time.Now().Before(ancestryCache.expiresAt) {
+        return ancestryCache.resources, nil
+    }
+
+    response, err := client.Projects.GetAncestry(projectID, &cloudresourcemanager.GetAncestryRequest{}).Context(ctx).Do()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get ancestry of project %s: %v", projectID, err)
+    }
+    resources := make([]iamResource, 0, len(response.Ancestor))
+    for _, ancestor := range response.Ancestor {
+        if ancestor.ResourceId != nil {
+            resources = append(resources, iamResource{Type: ancestor.ResourceId.Type, ID: ancestor.ResourceId.Id})
+        }
+    }
+    if len(resources) == 0 {
+        resources = []iamResource{{Type: "project", ID: projectID}}
+    }
+    log.Printf("[DEBUG] Ancestry of project %s: %v", projectID, resources)
+
+    ancestryCache.projectID = projectID
+    ancestryCache.resources = resources
+    ancestryCache.expiresAt = time.Now().Add(time.Duration(getBatchSize("IAM_ANCESTRY_CACHE_SECONDS", 3600)) * time.Second)
+    return resources, nil
+}
+
+// policyFetch is a resolution of a project's effective policy that concurrent requests share
+type policyFetch struct {
+    done   chan struct{}
+    policy *effectivePolicy
+    err    error
+}
+
+// getEffectivePolicy returns the allow bindings and deny rules of the project and all of its
+// ancestors, cached for IAM_POLICY_CACHE_SECONDS. Concurrent requests for a project whose policy
+// isn't cached share one resolution, which isn't cancelled with the request that started it.
+func getEffectivePolicy(ctx context.Context, projectID string) (*effectivePolicy, error) {
+    policyCache.Lock()
+    if policyCache.projectID == projectID && time.Now().Before(policyCache.expiresAt) {
+        policy := policyCache.policy
+        policyCache.Unlock()
+        return policy, nil
+    }
+    policyCache.Unlock()
+
+    fetch := &policyFetch{done: make(chan struct{})}
+    if actual, loaded := policyFetches.LoadOrStore(projectID, fetch); loaded {
+        log.Printf("[DEBUG] Waiting for in-flight IAM policy resolution of project %s", projectID)
+        fetch = actual.(*policyFetch)
+        select {
+        case <-fetch.done:
+            return fetch.policy, fetch.err
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+
+    fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+    defer cancel()
+    policy, err := fetchEffectivePolicy(fetchCtx, projectID)
+    if err == nil {
+        policyCache.Lock()
+        policyCache.projectID = projectID
+        policyCache.policy = policy
+        policyCache.expiresAt = time.Now().Add(time.Duration(getBatchSize("IAM_POLICY_CACHE_SECONDS", 60)) * time.Second)
+        policyCache.Unlock()
+    }
+
+    fetch.policy, fetch.err = policy, err
+    policyFetches.Delete(projectID)
+    close(fetch.done)
+    return policy, err
+}
+
+// iamAccessError returns a non-retryable error for IAM policies the service account may not
+// read, or an invalid IAM setting. Retrying doesn't fix either, so BigQuery shouldn't.
+func iamAccessError(format string, args ...interface{}) error {
+    return &requestError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+// fetchEffectivePolicy reads the allow and deny policies of the project and its ancestors.
+// Folder and organization allow and deny policies the service account may not read fail the
+// resolution, or are skipped with a warning if IAM_UNREADABLE_ANCESTORS is skip; all other
+// failures are errors.
+func fetchEffectivePolicy(ctx context.Context, projectID string) (*effectivePolicy, error) {
+    unreadable := strings.ToLower(os.Getenv("IAM_UNREADABLE_ANCESTORS"))
+    switch unreadable {
+    case "":
+        unreadable = UnreadableAncestorsFail
+    case UnreadableAncestorsFail, UnreadableAncestorsSkip:
+    default:
+        return nil, iamAccessError("unknown IAM_UNREADABLE_ANCESTORS: %s", unreadable)
+    }
+
+    // Initialize the Cloud Resource Manager client with default credentials
+    client, err := cloudresourcemanager.NewService(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create Cloud Resource Manager client: %v", err)
+    }
+    resources, err := getAncestry(ctx, client, projectID)
+    if err != nil {
+        return nil, err
+    }
+
+    policy := &effectivePolicy{}
+    var folders *cloudresourcemanagerv3.Service
+    for _, resource := range resources {
+        var bindings []iamBinding
+        switch resource.Type {
+        case "project":
+            bindings, err = getProjectBindings(ctx, client, resource)
+        case "organization":
+            bindings, err = getOrganizationBindings(ctx, client, resource)
+        case "folder":
+            if folders == nil {
+                if folders, err = cloudresourcemanagerv3.NewService(ctx); err != nil {
+                    return nil, fmt.Errorf("failed to create Cloud Resource Manager v3 client: %v", err)
+                }
+            }
+            bindings, err = getFolderBindings(ctx, folders, resource)
+        default:
+            log.Printf("[WARN] Skipping IAM policy of unknown resource type %s", resource)
+            continue
+        }
+        if err != nil {
+            if isPermissionDenied(err) {
+                if resource.Type == "project" {
+                    return nil, iamAccessError("not allowed to read IAM policy of %s: %v", resource, err)
+                }
+                if unreadable == UnreadableAncestorsSkip {
+                    log.Printf("[WARN] Not allowed to read IAM policy of %s, roles granted there are ignored: %v", resource, err)
+                    continue
+                }
+                return nil, iamAccessError("not allowed to read IAM policy of %s, grant the service account roles/iam.securityReviewer there or set IAM_UNREADABLE_ANCESTORS=skip: %v", resource, err)
+            }
+            return nil, fmt.Errorf("failed to get IAM policy of %s: %w", resource, err)
+        }
+        policy.Bindings = append(policy.Bindings, bindings...)
+    }
+
+    if policy.DenyRules, err = getDenyRules(ctx, resources, unreadable); err != nil {
+        return nil, err
+    }
+    return policy, nil
+}
+
+// getProjectBindings gets the allow policy bindings of the project. Bindings with a condition
+// are skipped, like conditional deny rules, since their conditions can't be evaluated here.
+func getProjectBindings(ctx context.Context, client *cloudresourcemanager.Service, resource iamResource) ([]iamBinding, error) {
+    policy, err := client.Projects.GetIamPolicy(resource.ID, &cloudresourcemanager.GetIamPolicyRequest{Options: &cloudresourcemanager.GetPolicyOptions{RequestedPolicyVersion: 3}}).Context(ctx).Do()
+    if err != nil {
+        return nil, err
+    }
+    bindings := make([]iamBinding, 0, len(policy.Bindings))
+    for _, binding := range policy.Bindings {
+        if binding.Condition != nil {
+            log.Printf("[DEBUG] Skipping conditional binding of %s on %s", binding.Role, resource)
+            continue
+        }
+        bindings = append(bindings, iamBinding{Resource: resource.String(), Role: binding.Role, Members: binding.Members})
+    }
+    return bindings, nil
+}
+
+// getOrganizationBindings gets the unconditional allow policy bindings of the organization
+func getOrganizationBindings(ctx context.Context, client *cloudresourcemanager.Service, resource iamResource) ([]iamBinding, error) {
+    policy, err := client.Organizations.GetIamPolicy(resource.String(), &cloudresourcemanager.GetIamPolicyRequest{Options: &cloudresourcemanager.GetPolicyOptions{RequestedPolicyVersion: 3}}).Context(ctx).Do()
+    if err != nil {
+        return nil, err
+    }
+    bindings := make([]iamBinding, 0, len(policy.Bindings))
+    for _, binding := range policy.Bindings {
+        if binding.Condition != nil {
+            log.Printf("[DEBUG] Skipping conditional binding of %s on %s", binding.Role, resource)
+            continue
+        }
+        bindings = append(bindings, iamBinding{Resource: resource.String(), Role: binding.Role, Members: binding.Members})
+    }
+    return bindings, nil
+}
+
+// getFolderBindings gets the unconditional allow policy bindings of a folder
+func getFolderBindings(ctx context.Context, client *cloudresourcemanagerv3.Service, resource iamResource) ([]iamBinding, error) {
+    policy, err := client.Folders.GetIamPolicy(resource.String(), &cloudresourcemanagerv3.GetIamPolicyRequest{Options: &cloudresourcemanagerv3.GetPolicyOptions{RequestedPolicyVersion: 3}}).Context(ctx).Do()
+    if err != nil {
+        return nil, err
+    }
+    bindings := make([]iamBinding, 0, len(policy.Bindings))
+    for _, binding := range policy.Bindings {
+        if binding.Condition != nil {
+            log.Printf("[DEBUG] Skipping conditional binding of %s on %s", binding.Role, resource)
+            continue
+        }
+        bindings = append(bindings, iamBinding{Resource: resource.String(), Role: binding.Role, Members: binding.Members})
+    }
+    return bindings, nil
+}
+
+// getDenyRules gets the rules of the deny policies attached to the resources. Deny rules with a
+// condition are skipped, since their conditions can't be evaluated here. Deny policies of the
+// project that can't be read fail closed: the caller gets no roles rather than roles that may be
+// denied. Those of folders and the organization do too, unless unreadable is skip, in which case
+// they are skipped with a warning.
+func getDenyRules(ctx context.Context, resources []iamResource, unreadable string) ([]denyRule, error) {
+    client, err := iamv2.NewService(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create IAM client: %v", err)
+    }
+
+    var rules []denyRule
+    for _, resource := range resources {
+        parent := "policies/" + url.PathEscape("cloudresourcemanager.googleapis.com/"+resource.String()) + "/denypolicies"
+        var names []string
+        err := client.Policies.ListPolicies(parent).Pages(ctx, func(page *iamv2.GoogleIamV2ListPoliciesResponse) error {
+            for _, policy := range page.Policies {
+                names = append(names, policy.Name)
+            }
+            return nil
+        })
+        if err != nil {
+            if isPermissionDenied(err) {
+                if resource.Type != "project" && unreadable == UnreadableAncestorsSkip {
+                    log.Printf("[WARN] Not allowed to list deny policies of %s, they are not enforced: %v", resource, err)
+                    continue
+                }
+                return nil, iamAccessError("not allowed to list deny policies of %s, grant the service account roles/iam.denyReviewer there: %v", resource, err)
+            }
+            return nil, fmt.Errorf("failed to list deny policies of %s: %w", resource, err)
+        }
+
+        // Listed policies leave out their rules
+        for _, name := range names {
+            policy, err := client.Policies.Get(name).Context(ctx).Do()
+            if err != nil {
+                return nil, fmt.Errorf("failed to get deny policy %s: %w", name, err)
+            }
+            for _, rule := range policy.Rules {
+                if rule.DenyRule == nil {
+                    continue
+                }
+                if rule.DenyRule.DenialCondition != nil && rule.DenyRule.DenialCondition.Expression != "" {
+                    log.Printf("[DEBUG] Skipping conditional rule of deny policy %s", name)
+                    continue
+                }
+                rules = append(rules, denyRule{
+                    Policy:               name,
+                    DeniedPrincipals:     rule.DenyRule.DeniedPrincipals,
+                    ExceptionPrincipals:  rule.DenyRule.ExceptionPrincipals,
+                    DeniedPermissions:    rule.DenyRule.DeniedPermissions,
+                    ExceptionPermissions: rule.DenyRule.ExceptionPermissions,
+                })
+            }
+        }
+    }
+    return rules, nil
+}
+
+// isPermissionDenied reports whether a Google API call failed because the caller may not make it
+func isPermissionDenied(err error) bool {
+    var apiErr *googleapi.Error
+    return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+// grantsToGroups reports whether any binding or deny rule names a Google group, in which case
+// the caller's group memberships are needed
+func (p *effectivePolicy) grantsToGroups() bool {
+    for _, binding := range p.Bindings {
+        for _, member := range binding.Members {
+            if strings.HasPrefix(member, "group:") {
+                return true
+            }
+        }
+    }
+    for _, rule := range p.DenyRules {
+        for _, principals := range [][]string{rule.DeniedPrincipals, rule.ExceptionPrincipals} {
+            for _, principal := range principals {
+                if strings.HasPrefix(principal, "principalSet://goog/group/") {
+                    return true
+                }
+            }
+        }
+    }
+    return false
+}
+
+// denyPrincipals returns the IAM v2 principal identifiers, in lower case, matching the
+// identity's IAM members (see identityMembers)
+func denyPrincipals(identities map[string]bool) map[string]bool {
+    principals := map[string]bool{"principalset://goog/public:all": true}
+    for member := range identities {
+        kind, id, _ := strings.Cut(member, ":")
+        switch kind {
+        case "user":
+            principals["principal://goog/subject/"+id] = true
+        case "serviceaccount":
+            principals["principal://iam.googleapis.com/projects/-/serviceaccounts/"+id] = true
+        case "group":
+            principals["principalset://goog/group/"+id] = true
+        }
+    }
+    return principals
+}
+
+// applies reports whether the rule denies permissions to any of the principals
+func (r denyRule) applies(principals map[string]bool) bool {
+    for _, principal := range r.ExceptionPrincipals {
+        if principals[strings.ToLower(principal)] {
+            return false
+        }
+    }
+    for _, principal := range r.DeniedPrincipals {
+        if principals[strings.ToLower(principal)] {
+            return true
+        }
+    }
+    return false
+}
+
+// denies reports whether the rule denies a permission given in role form, e.g. bigquery.tables.get
+func (r denyRule) denies(permission string) bool {
+    for _, exception := range r.ExceptionPermissions {
+        if denyPermissionMatches(exception, permission) {
+            return false
+        }
+    }
+    for _, denied := range r.DeniedPermissions {
+        if denyPermissionMatches(denied, permission) {
+            return true
+        }
+    }
+    return false
+}
+
+// denyPermissionMatches reports whether a deny policy permission such as
+// bigquery.googleapis.com/tables.get, bigquery.googleapis.com/tables.* or
+// bigquery.googleapis.com/* matches a permission in role form
+func denyPermissionMatches(pattern string, permission string) bool {
+    service, rest, ok := strings.Cut(pattern, ".googleapis.com/")
+    if !ok {
+        return false
+    }
+    parts := strings.SplitN(permission, ".", 2)
+    if len(parts) != 2 || parts[0] != service {
+        return false
+    }
+    if rest == "*" {
+        return true
+    }
+    patternParts := strings.Split(rest, ".")
+    permissionParts := strings.Split(parts[1], ".")
+    if len(patternParts) != len(permissionParts) {
+        return false
+    }
+    for i := range patternParts {
+        if patternParts[i] != "*" && patternParts[i] != permissionParts[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// removeDeniedRoles drops the roles whose every permission a deny rule denies to the identity,
+// since IAM grants nothing through them
+func removeDeniedRoles(ctx context.Context, roles []string, identities map[string]bool, rules []denyRule) ([]string, error) {
+    principals := denyPrincipals(identities)
+    var applicable []denyRule
+    for _, rule := range rules {
+        if rule.applies(principals) {
+            applicable = append(applicable, rule)
+        }
+    }
+    if len(applicable) == 0 {
+        return roles, nil
+    }
+
+    allowed := make([]string, 0, len(roles))
+    for _, role := range roles {
+        permissions, err := getRolePermissions(ctx, role)
+        if err != nil {
+            return nil, err
+        }
+        denied := len(permissions) > 0
+        for _, permission := range permissions {
+            deniedByRule := false
+            for _, rule := range applicable {
+                if rule.denies(permission) {
+                    deniedByRule = true
+                    break
+                }
+            }
+            if !deniedByRule {
+                denied = false
+                break
+            }
+        }
+        if denied {
+            log.Printf("[INFO] Role %s is denied by deny policies, ignoring it", role)
+            continue
+        }
+        allowed = append(allowed, role)
+    }
+    return allowed, nil
+}
+
+// getRolePermissions returns the permissions of a predefined or custom role
+func getRolePermissions(ctx context.Context, role string) ([]string, error) {
+    rolePermissionsCache.Lock()
+    defer rolePermissionsCache.Unlock()
+    if rolePermissionsCache.permissions == nil || time.Now().After(rolePermissionsCache.expiresAt) {
+        rolePermissionsCache.permissions = make(map[string][]string)
+        rolePermissionsCache.expiresAt = time.Now().Add(time.Duration(getBatchSize("IAM_ANCESTRY_CACHE_SECONDS", 3600)) * time.Second)
+    }
+    if permissions, ok := rolePermissionsCache.permissions[role]; ok {
+        return permissions, nil
+    }
+
+    client, err := iam.NewService(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create IAM client: %v", err)
+    }
+    var definition *iam.Role
+    switch {
+    case strings.HasPrefix(role, "projects/"):
+        definition, err = client.Projects.Roles.Get(role).Context(ctx).Do()
+    case strings.HasPrefix(role, "organizations/"):
+        definition, err = client.Organizations.Roles.Get(role).Context(ctx).Do()
+    default:
+        definition, err = client.Roles.Get(role).Context(ctx).Do()
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to get permissions of role %s: %v", role, err)
+    }
+
+    rolePermissionsCache.permissions[role] = definition.IncludedPermissions
+    return definition.IncludedPermissions, nil
+}
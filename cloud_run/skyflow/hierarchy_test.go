@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestDenyPermissionMatches(t *testing.T) {
+    tests := []struct {
+        pattern    string
+        permission string
+        want       bool
+    }{
+        {pattern: "bigquery.googleapis.com/tables.get", permission: "bigquery.tables.get", want: true},
+        {pattern: "bigquery.googleapis.com/tables.*", permission: "bigquery.tables.get", want: true},
+        {pattern: "bigquery.googleapis.com/*", permission: "bigquery.tables.get", want: true},
+        {pattern: "bigquery.googleapis.com/*.get", permission: "bigquery.datasets.get", want: true},
+        {pattern: "bigquery.googleapis.com/tables.get", permission: "bigquery.tables.getData"},
+        {pattern: "bigquery.googleapis.com/tables.*", permission: "bigquery.datasets.get"},
+        {pattern: "bigquery.googleapis.com/tables", permission: "bigquery.tables.get"},
+        {pattern: "iam.googleapis.com/roles.get", permission: "bigquery.roles.get"},
+        {pattern: "bigquery.googleapis.com/*", permission: "bigquerystorage.tables.get"},
+        {pattern: "bigquery.tables.get", permission: "bigquery.tables.get"},
+        {pattern: "bigquery.googleapis.com/tables.get", permission: "bigquery"},
+    }
+    for _, tt := range tests {
+        if got := denyPermissionMatches(tt.pattern, tt.permission); got != tt.want {
+            t.Errorf("denyPermissionMatches(%q, %q) = %t, want %t", tt.pattern, tt.permission, got, tt.want)
+        }
+    }
+}
+
+func TestDenyRule(t *testing.T) {
+    principals := denyPrincipals(map[string]bool{
+        "user:alice@example.com":           true,
+        "serviceaccount:alice@example.com": true,
+        "domain:example.com":               true,
+        "group:analysts@example.com":       true,
+    })
+    tests := []struct {
+        name        string
+        rule        denyRule
+        permission  string
+        wantApplies bool
+        wantDenies  bool
+    }{
+        {
+            name:        "user",
+            rule:        denyRule{DeniedPrincipals: []string{"principal://goog/subject/Alice@example.com"}, DeniedPermissions: []string{"bigquery.googleapis.com/*"}},
+            permission:  "bigquery.tables.get",
+            wantApplies: true,
+            wantDenies:  true,
+        },
+        {
+            name:        "group",
+            rule:        denyRule{DeniedPrincipals: []string{"principalSet://goog/group/analysts@example.com"}, DeniedPermissions: []string{"bigquery.googleapis.com/tables.get"}},
+            permission:  "bigquery.tables.get",
+            wantApplies: true,
+            wantDenies:  true,
+        },
+        {
+            name:        "everyone",
+            rule:        denyRule{DeniedPrincipals: []string{"principalSet://goog/public:all"}, DeniedPermissions: []string{"bigquery.googleapis.com/tables.get"}},
+            permission:  "bigquery.tables.list",
+            wantApplies: true,
+        },
+        {
+            name: "principal exception",
+            rule: denyRule{
+                DeniedPrincipals:    []string{"principalSet://goog/public:all"},
+                ExceptionPrincipals: []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/alice@example.com"},
+                DeniedPermissions:   []string{"bigquery.googleapis.com/*"},
+            },
+            permission: "bigquery.tables.get",
+            wantDenies: true,
+        },
+        {
+            name: "permission exception",
+            rule: denyRule{
+                DeniedPrincipals:     []string{"principal://goog/subject/alice@example.com"},
+                DeniedPermissions:    []string{"bigquery.googleapis.com/*"},
+                ExceptionPermissions: []string{"bigquery.googleapis.com/tables.get"},
+            },
+            permission:  "bigquery.tables.get",
+            wantApplies: true,
+        },
+        {
+            name:       "other user",
+            rule:       denyRule{DeniedPrincipals: []string{"principal://goog/subject/bob@example.com"}, DeniedPermissions: []string{"bigquery.googleapis.com/*"}},
+            permission: "bigquery.tables.get",
+            wantDenies: true,
+        },
+    }
+    for _, tt := range tests {
+        if got := tt.rule.applies(principals); got != tt.wantApplies {
+            t.Errorf("%s: applies = %t, want %t", tt.name, got, tt.wantApplies)
+        }
+        if got := tt.rule.denies(tt.permission); got != tt.wantDenies {
+            t.Errorf("%s: denies(%q) = %t, want %t", tt.name, tt.permission, got, tt.wantDenies)
+        }
+    }
+}
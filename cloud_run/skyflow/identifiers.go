@@ -0,0 +1,150 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "context"
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Maximum length of dataset and table IDs
+const maxDatasetTableIDLength = 1024
+
+var (
+    // Project IDs: lowercase letters, digits and hyphens, starting with a letter, optionally
+    // scoped to a domain (example.com:my-project)
+    projectIDPattern = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9.-]{0,61}[a-z0-9])?:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+    // Dataset IDs: letters, digits and underscores
+    datasetIDPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+    // Table IDs: letters, digits, underscores and hyphens
+    tableIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+    // Unquoted column names: letters, digits and underscores, not starting with a digit
+    plainColumnPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,299}$`)
+    // Quoted column names: any characters except backticks, backslashes and control characters
+    quotedColumnPattern = regexp.MustCompile("^`([^`\\\\\\x00-\\x1f]{1,300})`$")
+)
+
+// parseTableName parses a fully qualified project.dataset.table name. The project is everything
+// before the last two dots, so domain-scoped projects (example.com:my-project) are accepted. The
+// whole name may be enclosed in backticks; any other form is rejected.
+func parseTableName(name string) (tableRef, error) {
+    name = strings.TrimSpace(name)
+    if strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") && len(name) > 1 {
+        name = name[1 : len(name)-1]
+    }
+
+    tableDot := strings.LastIndex(name, ".")
+    datasetDot := -1
+    if tableDot > 0 {
+        datasetDot = strings.LastIndex(name[:tableDot], ".")
+    }
+    if datasetDot <= 0 {
+        return tableRef{}, badRequest("invalid table name %q: expected project.dataset.table", name)
+    }
+    parts := []string{name[:datasetDot], name[datasetDot+1 : tableDot], name[tableDot+1:]}
+    if !projectIDPattern.MatchString(parts[0]) {
+        return tableRef{}, badRequest("invalid project ID %q in table name", parts[0])
+    }
+    if len(parts[1]) > maxDatasetTableIDLength || !datasetIDPattern.MatchString(parts[1]) {
+        return tableRef{}, badRequest("invalid dataset ID %q in table name", parts[1])
+    }
+    if len(parts[2]) > maxDatasetTableIDLength || !tableIDPattern.MatchString(parts[2]) {
+        return tableRef{}, badRequest("invalid table ID %q in table name", parts[2])
+    }
+    return tableRef{ProjectID: parts[0], DatasetID: parts[1], TableID: parts[2]}, nil
+}
+
+// parseColumnName parses a plain or backtick-quoted column name and returns the unquoted name
+func parseColumnName(column string) (string, error) {
+    column = strings.TrimSpace(column)
+    if plainColumnPattern.MatchString(column) {
+        return column, nil
+    }
+    if match := quotedColumnPattern.FindStringSubmatch(column); match != nil {
+        return match[1], nil
+    }
+    return "", badRequest("invalid column name %q", column)
+}
+
+// parseColumnList parses a comma-separated list of column paths
+func parseColumnList(columns string) ([]string, error) {
+    columnList := make([]string, 0)
+    seen := make(map[string]bool)
+    for _, column := range strings.Split(columns, ",") {
+        path, err := parseColumnPath(column)
+        if err != nil {
+            return nil, err
+        }
+        name := path.String()
+        if seen[strings.ToLower(name)] {
+            return nil, badRequest("duplicate column %q", name)
+        }
+        seen[strings.ToLower(name)] = true
+        columnList = append(columnList, name)
+    }
+    return columnList, nil
+}
+
+// quoteIdentifier quotes a validated column name for use in a query
+func quoteIdentifier(name string) string {
+    return "`" + name + "`"
+}
+
+// getTableMetadata returns the metadata of a table
+func getTableMetadata(ctx context.Context, table tableRef) (*bigquery.TableMetadata, error) {
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return nil, err
+    }
+    defer bq.Close()
+
+    metadata, err := bq.table(table).Metadata(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("error getting metadata for table %s: %v", table, err)
+    }
+    return metadata, nil
+}
+
+// validateColumns checks each column path against the table's schema. Paths must exist and end
+// in a STRING field. Returns the paths with names as spelled in the schema.
+func validateColumns(schema bigquery.Schema, table tableRef, columns []string) ([]string, error) {
+    validated := make([]string, len(columns))
+    for i, column := range columns {
+        path, err := parseColumnPath(column)
+        if err != nil {
+            return nil, err
+        }
+        resolved, err := path.resolve(schema, table)
+        if err != nil {
+            return nil, err
+        }
+        validated[i] = resolved.String()
+    }
+    return validated, nil
+}
+
+// hasUpdatedAtColumn reports whether a schema has a TIMESTAMP updated_at column to touch when
+// values are tokenized
+func hasUpdatedAtColumn(schema bigquery.Schema) bool {
+    field := findField(schema, "updated_at")
+    return field != nil && field.Type == bigquery.TimestampFieldType && !field.Repeated
+}
+
+// findField finds a field in a schema by name. Column names are case-insensitive in BigQuery.
+func findField(schema bigquery.Schema, name string) *bigquery.FieldSchema {
+    for _, field := range schema {
+        if strings.EqualFold(field.Name, name) {
+            return field
+        }
+    }
+    return nil
+}
+
+// fieldTypeName returns the type of a field as written in BigQuery DDL
+func fieldTypeName(field *bigquery.FieldSchema) string {
+    if field.Repeated {
+        return fmt.Sprintf("ARRAY<%s>", field.Type)
+    }
+    return string(field.Type)
+}
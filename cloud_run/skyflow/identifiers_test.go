@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestParseTableName(t *testing.T) {
+    tests := []struct {
+        name    string
+        want    tableRef
+        wantErr bool
+    }{
+        {name: "my-project.dataset.table", want: tableRef{"my-project", "dataset", "table"}},
+        {name: "`my-project.dataset.table-1`", want: tableRef{"my-project", "dataset", "table-1"}},
+        {name: " my-project.Data_Set.t ", want: tableRef{"my-project", "Data_Set", "t"}},
+        {name: "example.com:my-project.dataset.table", want: tableRef{"example.com:my-project", "dataset", "table"}},
+        {name: "`example.com:my-project.dataset.table`", want: tableRef{"example.com:my-project", "dataset", "table"}},
+        {name: "dataset.table", wantErr: true},
+        {name: "table", wantErr: true},
+        {name: ".dataset.table", wantErr: true},
+        {name: "my-project..table", wantErr: true},
+        {name: "my-project.dataset.", wantErr: true},
+        {name: "p.dataset.table", wantErr: true},
+        {name: "My-Project.dataset.table", wantErr: true},
+        {name: "example.com:my-project:x.dataset.table", wantErr: true},
+        {name: "a.b.c.d", wantErr: true},
+        {name: "my-project.dataset.table; DROP TABLE x", wantErr: true},
+        {name: "my-project.dataset.`table`", wantErr: true},
+        {name: "my-project.data-set.table", wantErr: true},
+    }
+    for _, tt := range tests {
+        got, err := parseTableName(tt.name)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("parseTableName(%q) = %v, want error", tt.name, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parseTableName(%q) error: %v", tt.name, err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("parseTableName(%q) = %+v, want %+v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestParseColumnList(t *testing.T) {
+    tests := []struct {
+        columns string
+        want    []string
+        wantErr bool
+    }{
+        {columns: "email", want: []string{"email"}},
+        {columns: " email, `first name` ,_x1", want: []string{"email", "`first name`", "_x1"}},
+        {columns: "a;b", wantErr: true},
+        {columns: "`a`b`", wantErr: true},
+        {columns: "email) OR 1=1 --", wantErr: true},
+        {columns: "1abc", wantErr: true},
+        {columns: "", wantErr: true},
+        {columns: "`a\\b`", wantErr: true},
+        {columns: "x,X", wantErr: true},
+    }
+    for _, tt := range tests {
+        got, err := parseColumnList(tt.columns)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("parseColumnList(%q) = %v, want error", tt.columns, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parseColumnList(%q) error: %v", tt.columns, err)
+            continue
+        }
+        if len(got) != len(tt.want) {
+            t.Errorf("parseColumnList(%q) = %v, want %v", tt.columns, got, tt.want)
+            continue
+        }
+        for i := range got {
+            if got[i] != tt.want[i] {
+                t.Errorf("parseColumnList(%q) = %v, want %v", tt.columns, got, tt.want)
+                break
+            }
+        }
+    }
+}
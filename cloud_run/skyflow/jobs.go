@@ -0,0 +1,475 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Job states
+const (
+    JobStatePending   = "PENDING"
+    JobStateRunning   = "RUNNING"
+    JobStateSucceeded = "SUCCEEDED"
+    JobStateFailed    = "FAILED"
+)
+
+// TokenizeJob is an asynchronous tokenize_table run
+type TokenizeJob struct {
+    ID          string               `json:"job_id"`
+    State       string               `json:"state"`
+    Params      *tokenizeTableParams `json:"params"`
+    SessionUser string               `json:"-"`
+    Result      *tokenizeTableResult `json:"result,omitempty"`
+    Error       string               `json:"error,omitempty"`
+    CreatedAt   time.Time            `json:"created_at"`
+    UpdatedAt   time.Time            `json:"updated_at"`
+}
+
+// errJobNotFound is returned by job stores for unknown job IDs
+var errJobNotFound = errors.New("job not found")
+
+// Error of jobs whose instance stopped before they finished
+const abandonedJobError = "job was interrupted when its service instance stopped; submit it again to resume from its checkpoints"
+
+// jobStore persists tokenize jobs so their status can be read from any service instance
+type jobStore interface {
+    Create(ctx context.Context, job *TokenizeJob) error
+    Update(ctx context.Context, job *TokenizeJob) error
+    Get(ctx context.Context, jobID string) (*TokenizeJob, error)
+    // Heartbeat sets the update time of unfinished jobs, showing they are still queued or running
+    Heartbeat(ctx context.Context, jobIDs []string, at time.Time) error
+    // FailStale fails unfinished jobs that weren't updated since the given time
+    FailStale(ctx context.Context, before time.Time, reason string) error
+}
+
+var (
+    jobs     jobStore
+    jobQueue chan *TokenizeJob
+
+    // Jobs queued or running on this instance
+    activeJobs sync.Map // job ID -> struct{}
+)
+
+// startJobWorkers creates the job store and starts the worker pool for tokenize jobs
+func startJobWorkers() {
+    if tableName := os.Getenv("JOBS_TABLE"); tableName != "" {
+        table, err := parseTableName(tableName)
+        if err != nil {
+            log.Fatalf("[FATAL] Invalid JOBS_TABLE: %v", err)
+        }
+        jobs = &bigQueryJobStore{table: table}
+        log.Printf("[INFO] Using BigQuery job store: %s", table)
+    } else {
+        jobs = newMemoryJobStore()
+        log.Printf("[WARN] JOBS_TABLE is not set, job status is kept in memory and only visible to this instance")
+    }
+
+    workers := getBatchSize("TOKENIZE_JOB_WORKERS", 2)
+    jobQueue = make(chan *TokenizeJob, getBatchSize("TOKENIZE_JOB_QUEUE_SIZE", 100))
+    for i := 0; i < workers; i++ {
+        go jobWorker()
+    }
+    go monitorJobs(time.Duration(getBatchSize("TOKENIZE_JOB_STALE_SECONDS", 900)) * time.Second)
+    log.Printf("[INFO] Started %d tokenize job workers", workers)
+}
+
+// monitorJobs keeps the update time of this instance's jobs and the leases of its tokenize runs
+// current, and fails jobs and expires leases that weren't updated for the stale period. Those
+// belonged to an instance that stopped; jobs would otherwise stay PENDING or RUNNING forever, and
+// their runs could never be resumed.
+func monitorJobs(stale time.Duration) {
+    ticker := time.NewTicker(stale / 3)
+    defer ticker.Stop()
+    for {
+        ctx := context.Background()
+        jobIDs := make([]string, 0)
+        activeJobs.Range(func(key, value interface{}) bool {
+            jobIDs = append(jobIDs, key.(string))
+            return true
+        })
+        if len(jobIDs) > 0 {
+            if err := jobs.Heartbeat(ctx, jobIDs, time.Now().UTC()); err != nil {
+                log.Printf("[ERROR] Failed to record heartbeat of %d jobs: %v", len(jobIDs), err)
+            }
+        }
+        if err := jobs.FailStale(ctx, time.Now().UTC().Add(-stale), abandonedJobError); err != nil {
+            log.Printf("[ERROR] Failed to fail abandoned jobs: %v", err)
+        }
+
+        store := getCheckpointStore()
+        runKeys := make([]string, 0)
+        activeRuns.Range(func(key, value interface{}) bool {
+            runKeys = append(runKeys, key.(string))
+            return true
+        })
+        if len(runKeys) > 0 {
+            if err := store.Heartbeat(ctx, runKeys, getLeaseOwner(), time.Now().UTC()); err != nil {
+                log.Printf("[ERROR] Failed to renew leases of %d tokenize runs: %v", len(runKeys), err)
+            }
+        }
+        if err := store.ExpireLeases(ctx, time.Now().UTC().Add(-stale)); err != nil {
+            log.Printf("[ERROR] Failed to expire abandoned tokenize run leases: %v", err)
+        }
+        <-ticker.C
+    }
+}
+
+// jobWorker runs queued tokenize jobs
+func jobWorker() {
+    for job := range jobQueue {
+        runTokenizeJob(job)
+    }
+}
+
+// submitTokenizeJob registers a tokenize job and queues it for a worker. Returns the job ID.
+func submitTokenizeJob(params *tokenizeTableParams, sessionUser string) (string, error) {
+    jobID, err := newJobID()
+    if err != nil {
+        return "", err
+    }
+
+    now := time.Now().UTC()
+    job := &TokenizeJob{
+        ID:          jobID,
+        State:       JobStatePending,
+        Params:      params,
+        SessionUser: sessionUser,
+        CreatedAt:   now,
+        UpdatedAt:   now,
+    }
+    if err := jobs.Create(context.Background(), job); err != nil {
+        return "", fmt.Errorf("error registering job: %w", err)
+    }
+
+    activeJobs.Store(job.ID, struct{}{})
+    select {
+    case jobQueue <- job:
+    default:
+        activeJobs.Delete(job.ID)
+        job.State = JobStateFailed
+        job.Error = "job queue is full"
+        job.UpdatedAt = time.Now().UTC()
+        if err := jobs.Update(context.Background(), job); err != nil {
+            log.Printf("[ERROR] Failed to update job %s: %v", job.ID, err)
+        }
+        return "", &requestError{status: http.StatusTooManyRequests, err: errors.New("too many tokenize jobs queued, try again later")}
+    }
+
+    log.Printf("[INFO] Submitted tokenize job %s for table %s", job.ID, params.Table)
+    return job.ID, nil
+}
+
+// runTokenizeJob runs a tokenize job and records its outcome
+func runTokenizeJob(job *TokenizeJob) {
+    defer activeJobs.Delete(job.ID)
+    ctx := context.Background()
+    log.Printf("[INFO] Starting tokenize job %s for table %s", job.ID, job.Params.Table)
+
+    job.State = JobStateRunning
+    job.UpdatedAt = time.Now().UTC()
+    if err := jobs.Update(ctx, job); err != nil {
+        log.Printf("[ERROR] Failed to update job %s: %v", job.ID, err)
+    }
+
+    result, err := runTokenizeTable(ctx, job.Params, job.SessionUser)
+    if err != nil {
+        log.Printf("[ERROR] Tokenize job %s failed: %v", job.ID, err)
+        job.State = JobStateFailed
+        job.Error = err.Error()
+    } else {
+        log.Printf("[INFO] Tokenize job %s succeeded: %s", job.ID, result.message())
+        job.State = JobStateSucceeded
+    }
+    job.Result = result
+    job.UpdatedAt = time.Now().UTC()
+    if err := jobs.Update(ctx, job); err != nil {
+        log.Printf("[ERROR] Failed to update job %s: %v", job.ID, err)
+    }
+}
+
+// handleJobStatus handles job status requests. Each call replies with the job's status as JSON.
+// Only the user who submitted a job can see it; other users get the not found error.
+func handleJobStatus(req BigQueryRequest) (*BigQueryResponse, error) {
+    response := newResponseBuilder(req)
+    for i, call := range req.Calls {
+        if len(call) == 0 {
+            response.setError(i, badRequest("expected job ID argument"))
+            continue
+        }
+        jobID, ok := call[0].(string)
+        if !ok || jobID == "" {
+            response.setError(i, badRequest("invalid job ID format"))
+            continue
+        }
+
+        job, err := jobs.Get(context.Background(), jobID)
+        if err == nil && !strings.EqualFold(job.SessionUser, req.SessionUser) {
+            log.Printf("[WARN] User %s requested status of job %s submitted by another user", req.SessionUser, jobID)
+            err = errJobNotFound
+        }
+        if errors.Is(err, errJobNotFound) {
+            response.setError(i, badRequest("job %s not found", jobID))
+            continue
+        }
+        if err != nil {
+            response.setError(i, unavailable(fmt.Errorf("error getting job %s: %v", jobID, err)))
+            continue
+        }
+
+        status, err := json.Marshal(job)
+        if err != nil {
+            response.setError(i, fmt.Errorf("error encoding job status: %v", err))
+            continue
+        }
+        response.setReply(i, string(status))
+    }
+    return response.build()
+}
+
+// newJobID generates a random job ID
+func newJobID() (string, error) {
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        return "", fmt.Errorf("error generating job ID: %v", err)
+    }
+    return hex.EncodeToString(id), nil
+}
+
+// memoryJobStore keeps jobs in memory. Used when no jobs table is configured.
+type memoryJobStore struct {
+    sync.RWMutex
+    jobs map[string]TokenizeJob
+}
+
+func newMemoryJobStore() *memoryJobStore {
+    return &memoryJobStore{jobs: make(map[string]TokenizeJob)}
+}
+
+func (s *memoryJobStore) Create(ctx context.Context, job *TokenizeJob) error {
+    s.Lock()
+    defer s.Unlock()
+    s.jobs[job.ID] = *job
+    return nil
+}
+
+func (s *memoryJobStore) Update(ctx context.Context, job *TokenizeJob) error {
+    s.Lock()
+    defer s.Unlock()
+    if _, ok := s.jobs[job.ID]; !ok {
+        return errJobNotFound
+    }
+    s.jobs[job.ID] = *job
+    return nil
+}
+
+func (s *memoryJobStore) Get(ctx context.Context, jobID string) (*TokenizeJob, error) {
+    s.RLock()
+    defer s.RUnlock()
+    job, ok := s.jobs[jobID]
+    if !ok {
+        return nil, errJobNotFound
+    }
+    return &job, nil
+}
+
+func (s *memoryJobStore) Heartbeat(ctx context.Context, jobIDs []string, at time.Time) error {
+    s.Lock()
+    defer s.Unlock()
+    for _, jobID := range jobIDs {
+        if job, ok := s.jobs[jobID]; ok && isUnfinishedJob(job.State) {
+            job.UpdatedAt = at
+            s.jobs[jobID] = job
+        }
+    }
+    return nil
+}
+
+func (s *memoryJobStore) FailStale(ctx context.Context, before time.Time, reason string) error {
+    s.Lock()
+    defer s.Unlock()
+    for jobID, job := range s.jobs {
+        if isUnfinishedJob(job.State) && job.UpdatedAt.Before(before) {
+            log.Printf("[WARN] Failing abandoned job %s, last updated at %s", jobID, job.UpdatedAt.Format(time.RFC3339))
+            job.State = JobStateFailed
+            job.Error = reason
+            job.UpdatedAt = time.Now().UTC()
+            s.jobs[jobID] = job
+        }
+    }
+    return nil
+}
+
+// isUnfinishedJob reports whether a job in the given state is queued or running
+func isUnfinishedJob(state string) bool {
+    return state == JobStatePending || state == JobStateRunning
+}
+
+// bigQueryJobStore keeps jobs in a BigQuery control table (see sql/create_jobs_table.sql)
+type bigQueryJobStore struct {
+    table tableRef
+}
+
+func (s *bigQueryJobStore) Create(ctx context.Context, job *TokenizeJob) error {
+    params, err := jobParameters(job)
+    if err != nil {
+        return err
+    }
+
+    query := fmt.Sprintf(`
+INSERT INTO %s (job_id, state, params, requested_by, result, error, created_at, updated_at)
+VALUES (@job_id, @state, @params, @requested_by, @result, @error, @created_at, @updated_at)`, s.table.sql())
+    return executeControlQuery(ctx, query, params)
+}
+
+func (s *bigQueryJobStore) Update(ctx context.Context, job *TokenizeJob) error {
+    params, err := jobParameters(job)
+    if err != nil {
+        return err
+    }
+
+    query := fmt.Sprintf(`
+UPDATE %s
+SET state = @state, result = @result, error = @error, updated_at = @updated_at
+WHERE job_id = @job_id`, s.table.sql())
+    return executeControlQuery(ctx, query, selectParameters(params, "job_id", "state", "result", "error", "updated_at"))
+}
+
+func (s *bigQueryJobStore) Get(ctx context.Context, jobID string) (*TokenizeJob, error) {
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return nil, err
+    }
+    defer bq.Close()
+
+    query := fmt.Sprintf(`
+SELECT job_id, state, params, result, error, created_at, updated_at, requested_by
+FROM %s
+WHERE job_id = @job_id`, s.table.sql())
+    rows, err := bq.Query(ctx, query, bigquery.QueryParameter{Name: "job_id", Value: jobID})
+    if err != nil {
+        return nil, err
+    }
+    if len(rows) == 0 {
+        return nil, errJobNotFound
+    }
+
+    row := rows[0]
+    job := &TokenizeJob{
+        ID:          stringValue(row[0]),
+        State:       stringValue(row[1]),
+        Error:       stringValue(row[4]),
+        SessionUser: stringValue(row[7]),
+    }
+    if params := stringValue(row[2]); params != "" {
+        if err := json.Unmarshal([]byte(params), &job.Params); err != nil {
+            return nil, fmt.Errorf("error decoding job params: %v", err)
+        }
+    }
+    if result := stringValue(row[3]); result != "" {
+        if err := json.Unmarshal([]byte(result), &job.Result); err != nil {
+            return nil, fmt.Errorf("error decoding job result: %v", err)
+        }
+    }
+    if createdAt, ok := row[5].(time.Time); ok {
+        job.CreatedAt = createdAt
+    }
+    if updatedAt, ok := row[6].(time.Time); ok {
+        job.UpdatedAt = updatedAt
+    }
+    return job, nil
+}
+
+func (s *bigQueryJobStore) Heartbeat(ctx context.Context, jobIDs []string, at time.Time) error {
+    query := fmt.Sprintf(`
+UPDATE %s
+SET updated_at = @updated_at
+WHERE job_id IN UNNEST(@job_ids) AND state IN (@pending, @running)`, s.table.sql())
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "updated_at", Value: at},
+        {Name: "job_ids", Value: jobIDs},
+        {Name: "pending", Value: JobStatePending},
+        {Name: "running", Value: JobStateRunning},
+    })
+}
+
+func (s *bigQueryJobStore) FailStale(ctx context.Context, before time.Time, reason string) error {
+    query := fmt.Sprintf(`
+UPDATE %s
+SET state = @failed, error = @error, updated_at = CURRENT_TIMESTAMP()
+WHERE state IN (@pending, @running) AND updated_at < @before`, s.table.sql())
+    return executeControlQuery(ctx, query, []bigquery.QueryParameter{
+        {Name: "failed", Value: JobStateFailed},
+        {Name: "error", Value: reason},
+        {Name: "pending", Value: JobStatePending},
+        {Name: "running", Value: JobStateRunning},
+        {Name: "before", Value: before},
+    })
+}
+
+// jobParameters returns the query parameters describing a job row
+func jobParameters(job *TokenizeJob) ([]bigquery.QueryParameter, error) {
+    params, err := json.Marshal(job.Params)
+    if err != nil {
+        return nil, fmt.Errorf("error encoding job params: %v", err)
+    }
+    result := []byte{}
+    if job.Result != nil {
+        if result, err = json.Marshal(job.Result); err != nil {
+            return nil, fmt.Errorf("error encoding job result: %v", err)
+        }
+    }
+
+    return []bigquery.QueryParameter{
+        {Name: "job_id", Value: job.ID},
+        {Name: "state", Value: job.State},
+        {Name: "params", Value: string(params)},
+        {Name: "requested_by", Value: job.SessionUser},
+        {Name: "result", Value: string(result)},
+        {Name: "error", Value: job.Error},
+        {Name: "created_at", Value: job.CreatedAt},
+        {Name: "updated_at", Value: job.UpdatedAt},
+    }, nil
+}
+
+// selectParameters returns the named parameters, so statements only receive the parameters they use
+func selectParameters(params []bigquery.QueryParameter, names ...string) []bigquery.QueryParameter {
+    selected := make([]bigquery.QueryParameter, 0, len(names))
+    for _, name := range names {
+        for _, param := range params {
+            if param.Name == name {
+                selected = append(selected, param)
+            }
+        }
+    }
+    return selected
+}
+
+// executeControlQuery runs a DML statement against a control table
+func executeControlQuery(ctx context.Context, query string, params []bigquery.QueryParameter) error {
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return err
+    }
+    defer bq.Close()
+
+    return bq.Update(ctx, query, params...)
+}
+
+// stringValue converts a nullable BigQuery STRING value to a string
+func stringValue(value interface{}) string {
+    if s, ok := value.(string); ok {
+        return s
+    }
+    return ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    cloudkms "google.golang.org/api/cloudkms/v1"
+    "context"
+    "crypto"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "fmt"
+    "regexp"
+    "sync"
+)
+
+// Cloud KMS key version resource names
+var kmsKeyVersionPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+/cryptoKeyVersions/[^/]+$`)
+
+// Digest signed by each supported Cloud KMS signing algorithm, 0 for algorithms signing the
+// message itself. RSA-PSS keys and digests without a JWT algorithm aren't supported.
+var kmsAlgorithmHashes = map[string]crypto.Hash{
+    "RSA_SIGN_PKCS1_2048_SHA256": crypto.SHA256,
+    "RSA_SIGN_PKCS1_3072_SHA256": crypto.SHA256,
+    "RSA_SIGN_PKCS1_4096_SHA256": crypto.SHA256,
+    "EC_SIGN_P256_SHA256":        crypto.SHA256,
+    "EC_SIGN_ED25519":            0,
+}
+
+var (
+    kmsServiceOnce sync.Once
+    kmsService     *cloudkms.Service
+    kmsServiceErr  error
+)
+
+// getKMSService returns the Cloud KMS client, created on first use
+func getKMSService() (*cloudkms.Service, error) {
+    kmsServiceOnce.Do(func() {
+        kmsService, kmsServiceErr = cloudkms.NewService(context.Background())
+    })
+    if kmsServiceErr != nil {
+        return nil, fmt.Errorf("failed to create Cloud KMS client: %v", kmsServiceErr)
+    }
+    return kmsService, nil
+}
+
+// kmsSigner is a keySigner backed by a Cloud KMS asymmetric signing key version, so the private
+// key never leaves KMS. The service account needs roles/cloudkms.signerVerifier on the key.
+type kmsSigner struct {
+    service *cloudkms.Service
+    keyName string
+    hash    crypto.Hash
+    public  crypto.PublicKey
+}
+
+// newKMSSigner returns the signer of a Cloud KMS key version, named
+// projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*. The key's public key is
+// read once, to pick the JWT algorithm.
+func newKMSSigner(ctx context.Context, keyName string) (keySigner, error) {
+    if !kmsKeyVersionPattern.MatchString(keyName) {
+        return nil, fmt.Errorf("invalid Cloud KMS key version name %q", keyName)
+    }
+    service, err := getKMSService()
+    if err != nil {
+        return nil, err
+    }
+
+    key, err := service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.GetPublicKey(keyName).Context(ctx).Do()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get public key of %s: %v", keyName, err)
+    }
+    hash, ok := kmsAlgorithmHashes[key.Algorithm]
+    if !ok {
+        return nil, fmt.Errorf("unsupported Cloud KMS algorithm %s of %s", key.Algorithm, keyName)
+    }
+    block, _ := pem.Decode([]byte(key.Pem))
+    if block == nil {
+        return nil, fmt.Errorf("failed to parse PEM public key of %s", keyName)
+    }
+    public, err := x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse public key of %s: %v", keyName, err)
+    }
+    return &kmsSigner{service: service, keyName: keyName, hash: hash, public: public}, nil
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+    return s.public
+}
+
+func (s *kmsSigner) Sign(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+    if hash != s.hash {
+        return nil, fmt.Errorf("Cloud KMS key %s signs %v digests, not %v", s.keyName, s.hash, hash)
+    }
+
+    encoded := base64.StdEncoding.EncodeToString(digest)
+    req := &cloudkms.AsymmetricSignRequest{}
+    switch hash {
+    case crypto.SHA256:
+        req.Digest = &cloudkms.Digest{Sha256: encoded}
+    case 0:
+        req.Data = encoded
+    }
+    resp, err := s.service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.AsymmetricSign(s.keyName, req).Context(ctx).Do()
+    if err != nil {
+        return nil, fmt.Errorf("Cloud KMS failed to sign with %s: %v", s.keyName, err)
+    }
+    signature, err := base64.StdEncoding.DecodeString(resp.Signature)
+    if err != nil {
+        return nil, fmt.Errorf("invalid signature from Cloud KMS key %s: %v", s.keyName, err)
+    }
+    return signature, nil
+}
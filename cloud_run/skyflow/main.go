@@ -5,18 +5,11 @@ import (
     "cloud.google.com/go/bigquery"
     secretmanager "cloud.google.com/go/secretmanager/apiv1"
     secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
-    cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
     "google.golang.org/api/iterator"
     "bytes"
     "context"
-    "crypto"
-    "crypto/rand"
-    "crypto/rsa"
-    "crypto/sha256"
-    "crypto/x509"
     "encoding/base64"
     "encoding/json"
-    "encoding/pem"
     "errors"
     "fmt"
     "io/ioutil"
@@ -27,12 +20,14 @@ import (
     "strings"
     "sync"
     "time"
+    "unicode/utf8"
 )
 
 // RoleConfig represents the role configuration loaded from Secret Manager
 type RoleConfig struct {
-    DefaultRoleID string        `json:"defaultRoleID"` // Default Skyflow role ID for unmapped roles
-    RoleMappings  []RoleMapping `json:"roleMappings"`  // Direct mapping of Skyflow role IDs to Google roles
+    DefaultRoleID  string          `json:"defaultRoleID"`  // Default Skyflow role ID for unmapped roles
+    RoleMappings   []RoleMapping   `json:"roleMappings"`   // Direct mapping of Skyflow role IDs to Google roles
+    ColumnMappings []ColumnMapping `json:"columnMappings"` // Skyflow fields of BigQuery columns; unmapped columns use the pii field
 }
 
 // RoleMapping represents a mapping between a Skyflow role ID and Google IAM roles
@@ -116,6 +111,10 @@ func getRoleConfig() *RoleConfig {
         log.Printf("[INFO] - Mapping %d: Skyflow role ID '%s' maps to Google roles: %v", 
             i+1, roleMapping.SkyflowRoleID, roleMapping.GoogleRoles)
     }
+    for _, columnMapping := range config.ColumnMappings {
+        log.Printf("[INFO] - Column '%s' (table: '%s') maps to Skyflow field '%s.%s'",
+            columnMapping.Column, columnMapping.Table, columnMapping.SkyflowTable, columnMapping.SkyflowField)
+    }
 
     return &config
 }
@@ -125,9 +124,7 @@ const (
     OpTokenizeValue = "tokenize_value"
     OpTokenizeTable = "tokenize_table"
     OpDetokenize    = "detokenize"
-
-    // Minimum length for PII values
-    minPiiLength = 7
+    OpJobStatus     = "job_status"
 )
 
 // Operation to required roles mapping
@@ -135,6 +132,7 @@ var operationRoles = map[string][]string{
     OpTokenizeValue: {}, // Allow any role to run this BigQuery Function (controls only ability to run BigQuery function itself. PII access is controlled at Skyflow level via role mappings)
     OpTokenizeTable: {}, // Allow any role to run this BigQuery Function (controls only ability to run BigQuery function itself. PII access is controlled at Skyflow level via role mappings)
     OpDetokenize:    {}, // Allow any role to run this BigQuery Function (controls only ability to run BigQuery function itself. PII access is controlled at Skyflow level via role mappings)
+    OpJobStatus:     {}, // Allow any role to check the status of tokenize_table jobs
 }
 
 // Cache structure for tokenization results (within same request)
@@ -146,11 +144,9 @@ type tokenPromise struct {
 
 var (
     // Cache for in-flight requests
-    inFlightRequests sync.Map // value -> *tokenPromise
-    // Cache for bearer tokens
-    bearerTokenCache sync.Map // roleID:userEmail -> token
-    mutex            sync.Mutex
-    credentials      *SkyflowCredentials
+    inFlightRequests sync.Map // fieldValue -> *tokenPromise
+    // Tokenize runs in progress on this instance, whose leases it renews
+    activeRuns sync.Map // run key -> struct{}
 )
 
 // SkyflowCredentials holds the credentials from credentials.json
@@ -163,6 +159,10 @@ type SkyflowCredentials struct {
     KeyValidAfterTime  string `json:"keyValidAfterTime"`
     KeyValidBeforeTime string `json:"keyValidBeforeTime"`
     KeyAlgorithm      string `json:"keyAlgorithm"`
+    SignerKeyName     string `json:"signerKeyName"` // Cloud KMS key version signing instead of privateKey
+
+    signerMutex sync.Mutex
+    signer      *jwtSigner
 }
 
 // BigQueryRequest represents the request from BigQuery
@@ -178,16 +178,59 @@ type BigQueryResponse struct {
     Replies []interface{} `json:"replies"`
 }
 
-// TokenizeValueRequest represents the request for single value tokenization
+// UserDefinedContext holds the user_defined_context options of the remote function
+type UserDefinedContext struct {
+    Operation           string `json:"operation"`
+    AllowPartialResults string `json:"allow_partial_results"` // "true" to return NULL for calls that fail permanently
+    Async               string `json:"async"`                 // "true" to run tokenize_table as a background job
+    Filter              string `json:"filter"`                // Predicate restricting the rows tokenize_table reads and updates
+    Partition           string `json:"partition"`             // Partition ID restricting tokenize_table to one partition
+    WatermarkColumn     string `json:"watermark_column"`      // Column tracking rows already tokenized by earlier runs
+    TouchUpdatedAt      string `json:"touch_updated_at"`      // "true" to set updated_at on rows tokenize_table changes
+}
+
+// userContext parses the user defined context of the request
+func (req BigQueryRequest) userContext() (UserDefinedContext, error) {
+    var userContext UserDefinedContext
+    if len(req.UserDefinedContext) == 0 {
+        return userContext, nil
+    }
+    if err := json.Unmarshal(req.UserDefinedContext, &userContext); err != nil {
+        return userContext, err
+    }
+    return userContext, nil
+}
+
+// asyncJobs reports whether tokenize_table calls should run as background jobs
+func (c UserDefinedContext) asyncJobs() bool {
+    async, _ := strconv.ParseBool(c.Async)
+    return async
+}
+
+// allowPartialResults reports whether failed calls may reply NULL instead of failing the request
+func (c UserDefinedContext) allowPartialResults() bool {
+    allow, _ := strconv.ParseBool(c.AllowPartialResults)
+    return allow
+}
+
+// touchUpdatedAt reports whether tokenize_table should set updated_at on the rows it tokenizes
+func (c UserDefinedContext) touchUpdatedAt() bool {
+    touch, _ := strconv.ParseBool(c.TouchUpdatedAt)
+    return touch
+}
+
+// TokenizeValueRequest represents the request for value tokenization
 type TokenizeValueRequest struct {
-    TokenizationParameters []struct {
-        Column string `json:"column"`
-        Table  string `json:"table"`
-        Value  string `json:"value"`
-    } `json:"tokenizationParameters"`
+    TokenizationParameters []TokenizationParameter `json:"tokenizationParameters"`
+}
+
+type TokenizationParameter struct {
+    Column string `json:"column"`
+    Table  string `json:"table"`
+    Value  string `json:"value"`
 }
 
-// TokenizeValueResponse represents the response for single value tokenization
+// TokenizeValueResponse represents the response for value tokenization
 type TokenizeValueResponse struct {
     Records []struct {
         Token string `json:"token"`
@@ -198,6 +241,27 @@ type TokenizeValueResponse struct {
 type TokenizeTableRequest struct {
     Records      []Record `json:"records"`
     Tokenization bool     `json:"tokenization"`
+    Upsert       string   `json:"upsert,omitempty"` // Unique field; records matching an existing record's value update it instead of being inserted
+}
+
+// idempotentRequest is implemented by Skyflow requests that are only safe to send twice in some
+// cases. Other requests are retried freely.
+type idempotentRequest interface {
+    idempotent() bool
+}
+
+// idempotent reports whether the request can be sent twice without inserting records twice,
+// which holds for upserts
+func (r TokenizeTableRequest) idempotent() bool {
+    return r.Upsert != ""
+}
+
+// TokenizeTableResponse represents the response for table tokenization
+type TokenizeTableResponse struct {
+    Records []struct {
+        SkyflowID string            `json:"skyflow_id"`
+        Tokens    map[string]string `json:"tokens"`
+    } `json:"records"`
 }
 
 type Record struct {
@@ -208,6 +272,7 @@ type Record struct {
 // DetokenizeRequest represents the request for detokenization
 type DetokenizeRequest struct {
     DetokenizationParameters []TokenParam `json:"detokenizationParameters"`
+    ContinueOnError          bool         `json:"continueOnError,omitempty"` // Return per-token errors instead of failing the request
 }
 
 type TokenParam struct {
@@ -283,7 +348,14 @@ func main() {
     // Load initial role configuration
     getRoleConfig() // This will load and cache the initial configuration
 
-    http.HandleFunc("/", handleRequest)
+    // Start workers for asynchronous tokenize_table jobs
+    startJobWorkers()
+
+    // Pick up rotated Skyflow credentials without a redeploy
+    startCredentialRotation()
+
+    http.HandleFunc("/", requireIdentityToken(handleRequest))
+    http.HandleFunc("/health", handleHealth)
     port := os.Getenv("PORT")
     if port == "" {
         port = "8080"
@@ -303,7 +375,7 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
     // Read request body
     body, err := ioutil.ReadAll(r.Body)
     if err != nil {
-        http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+        writeError(w, badRequest("error reading request body: %v", err))
         return
     }
     log.Printf("[INFO] Received request: Method=%s, ContentLength=%d", r.Method, r.ContentLength)
@@ -313,45 +385,54 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
     var bqReq BigQueryRequest
     if err := json.Unmarshal(body, &bqReq); err != nil {
         log.Printf("[ERROR] Failed to parse request body: %v", err)
-        http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+        writeError(w, badRequest("error decoding request: %v", err))
         return
     }
 
     // Validate session user
     if bqReq.SessionUser == "" {
-        http.Error(w, "SessionUser is required", http.StatusBadRequest)
+        writeError(w, badRequest("sessionUser is required"))
         return
     }
 
     // Get operation from userDefinedContext
-    var userContext struct {
-        Operation string `json:"operation"`
-    }
-    if err := json.Unmarshal(bqReq.UserDefinedContext, &userContext); err != nil {
+    userContext, err := bqReq.userContext()
+    if err != nil {
         log.Printf("[ERROR] Failed to parse user defined context: %v", err)
-        http.Error(w, fmt.Sprintf("Error parsing user defined context: %v", err), http.StatusBadRequest)
+        writeError(w, badRequest("error parsing user defined context: %v", err))
         return
     }
     operation := userContext.Operation
-    log.Printf("[INFO] Processing %s operation for user: %s", operation, bqReq.SessionUser)
+    callerEmail := ""
+    if caller, ok := callerFromContext(r.Context()); ok {
+        callerEmail = caller.Email
+    }
+    log.Printf("[INFO] Processing %s operation for user: %s (caller: %s)", operation, bqReq.SessionUser, callerEmail)
     if operation == "" {
-        http.Error(w, "Operation not specified in user_defined_context", http.StatusBadRequest)
+        writeError(w, badRequest("operation not specified in user_defined_context"))
         return
     }
 
+    // Skyflow calls, including their retries, must finish before the caller gives up
+    ctx, cancel := context.WithTimeout(r.Context(), time.Duration(getBatchSize("REQUEST_TIMEOUT_SECONDS", 300))*time.Second)
+    defer cancel()
+
     // Get user roles
     log.Printf("[INFO] Getting roles for user: %s", bqReq.SessionUser)
-    roles, err := getUserRoles(r.Context(), bqReq.SessionUser)
+    roles, err := getUserRoles(ctx, bqReq.SessionUser)
     log.Printf("[INFO] User roles: %v", roles)
     if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting user roles: %v", err), http.StatusInternalServerError)
+        writeError(w, fmt.Errorf("error getting user roles: %w", orUnavailable(err)))
         return
     }
 
     // Check if user has required role
     _, hasRole := hasRequiredRole(roles, operationRoles[operation])
     if !hasRole {
-        http.Error(w, fmt.Sprintf("User does not have required role for %s operation", operation), http.StatusForbidden)
+        writeError(w, &requestError{
+            status: http.StatusForbidden,
+            err:    fmt.Errorf("user does not have required role for %s operation", operation),
+        })
         return
     }
 
@@ -359,258 +440,902 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
     var response interface{}
     switch operation {
     case OpTokenizeValue:
-        response, err = handleTokenizeValue(bqReq)
+        response, err = handleTokenizeValue(ctx, bqReq)
     case OpTokenizeTable:
-        response, err = handleTokenizeTable(bqReq)
+        response, err = handleTokenizeTable(ctx, bqReq)
     case OpDetokenize:
-        response, err = handleDetokenize(bqReq, roles)
+        response, err = handleDetokenize(ctx, bqReq, roles)
+    case OpJobStatus:
+        response, err = handleJobStatus(bqReq)
     default:
-        http.Error(w, fmt.Sprintf("Unknown operation: %s", operation), http.StatusBadRequest)
+        writeError(w, badRequest("unknown operation: %s", operation))
         return
     }
 
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        writeError(w, err)
         return
     }
 
     // Return response
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
+    writeResponse(w, response)
 }
 
-// handleTokenizeValue handles single value tokenization requests
-func handleTokenizeValue(req BigQueryRequest) (*BigQueryResponse, error) {
-    value, ok := req.Calls[0][0].(string)
-    if !ok {
-        return nil, fmt.Errorf("invalid value format: expected string")
+// handleTokenizeValue handles value tokenization requests. Every call in the request is
+// tokenized into the Skyflow field given as the optional second argument (the default field if
+// NULL); duplicate values are sent to Skyflow once and replies are returned in call order. Short
+// values are treated according to the field's short value policy.
+func handleTokenizeValue(ctx context.Context, req BigQueryRequest) (*BigQueryResponse, error) {
+    response := newResponseBuilder(req)
+    values := make(map[int]fieldValue, len(req.Calls))
+    uniqueValues := make([]fieldValue, 0, len(req.Calls))
+    seen := make(map[fieldValue]bool)
+    for i, call := range req.Calls {
+        if len(call) == 0 || call[0] == nil {
+            continue
+        }
+        value, ok := call[0].(string)
+        if !ok {
+            response.setError(i, badRequest("invalid value format: expected string"))
+            continue
+        }
+        if value == "" {
+            response.setReply(i, value)
+            continue
+        }
+
+        fieldName := ""
+        if len(call) > 1 && call[1] != nil {
+            if fieldName, ok = call[1].(string); !ok {
+                response.setError(i, badRequest("invalid Skyflow field format: expected string"))
+                continue
+            }
+        }
+        field, err := parseSkyflowField(fieldName)
+        if err != nil {
+            response.setError(i, err)
+            continue
+        }
+
+        // Treat short values the way tokenize_table treats them in columns mapped to the field
+        policy, err := shortValuePolicyForField(field)
+        if err != nil {
+            response.setError(i, err)
+            continue
+        }
+        if policy.isShort(value) {
+            switch policy.Action {
+            case ShortValuePad:
+                value = policy.pad(value)
+            case ShortValueNull:
+                response.setReply(i, nil)
+                continue
+            case ShortValueRedact:
+                response.setReply(i, policy.Marker)
+                continue
+            case ShortValueFail:
+                response.setError(i, badRequest("value is shorter than the minimum length of %d", policy.MinLength))
+                continue
+            }
+        }
+
+        item := fieldValue{Field: field, Value: value}
+        values[i] = item
+        if !seen[item] {
+            seen[item] = true
+            uniqueValues = append(uniqueValues, item)
+        }
     }
 
-    if value == "" {
-        return &BigQueryResponse{Replies: []interface{}{value}}, nil
+    tokens, errs := tokenizeValues(ctx, uniqueValues, req.SessionUser)
+
+    // Map tokens back to the original call order
+    for i, value := range values {
+        if err, failed := errs[value]; failed {
+            response.setError(i, err)
+            continue
+        }
+        response.setReply(i, tokens[value])
+    }
+
+    return response.build()
+}
+
+// fieldValue is a value to tokenize into a Skyflow field
+type fieldValue struct {
+    Field skyflowField
+    Value string
+}
+
+// tokenizeValues returns the Skyflow token for each of the given unique values, and the error for
+// each value that could not be tokenized. Values that are already being tokenized by a concurrent
+// request are awaited instead of being sent again.
+func tokenizeValues(ctx context.Context, values []fieldValue, userEmail string) (map[fieldValue]string, map[fieldValue]error) {
+    tokens := make(map[fieldValue]string, len(values))
+    errs := make(map[fieldValue]error)
+    owned := make([]fieldValue, 0, len(values))
+    promises := make(map[fieldValue]*tokenPromise, len(values))
+    waiting := make(map[fieldValue]*tokenPromise)
+
+    // Check/create in-flight promises
+    for _, value := range values {
+        promise := &tokenPromise{done: make(chan struct{})}
+        actual, loaded := inFlightRequests.LoadOrStore(value, promise)
+        if loaded {
+            waiting[value] = actual.(*tokenPromise)
+            continue
+        }
+        promises[value] = promise
+        owned = append(owned, value)
+    }
+
+    // Tokenize the values we own in concurrent batches. A failed batch only fails its own values.
+    batchSize := getBatchSize("SKYFLOW_INSERT_BATCH_SIZE", 25)
+    log.Printf("Making Skyflow API calls for %d values (%d awaiting in-flight requests)", len(owned), len(waiting))
+    var mu sync.Mutex
+    processor := func(ctx context.Context, batch []fieldValue) ([]fieldValue, error) {
+        batchTokens, err := tokenizeValueBatch(ctx, batch, userEmail)
+        mu.Lock()
+        defer mu.Unlock()
+        for i, value := range batch {
+            if err != nil {
+                errs[value] = err
+                completeTokenPromise(promises[value], value, "", err)
+                continue
+            }
+            tokens[value] = batchTokens[i]
+            completeTokenPromise(promises[value], value, batchTokens[i], nil)
+        }
+        return batch, nil
+    }
+    concurrency := getBatchSize("SKYFLOW_INSERT_CONCURRENCY", 4)
+    limiter := sharedRateLimiter("SKYFLOW_INSERT_RATE_LIMIT")
+    if _, err := concurrentBatchProcessor(ctx, owned, batchSize, concurrency, limiter, processor); err != nil {
+        // Batches that never started, e.g. because the request ended, fail their values so
+        // requests awaiting them don't hang
+        for _, value := range owned {
+            if _, ok := tokens[value]; ok {
+                continue
+            }
+            if _, ok := errs[value]; ok {
+                continue
+            }
+            errs[value] = err
+            completeTokenPromise(promises[value], value, "", err)
+        }
     }
 
-    // Check/create in-flight promise
-    promise := &tokenPromise{done: make(chan struct{})}
-    actual, loaded := inFlightRequests.LoadOrStore(value, promise)
-    if loaded {
-        // Another request is already processing this value
-        log.Printf("Waiting for in-flight request for value: %s", value)
-        p := actual.(*tokenPromise)
-        <-p.done  // Wait for it to complete
-        return &BigQueryResponse{Replies: []interface{}{p.token}}, p.err
+    // Wait for values being tokenized by other requests, but no longer than this request may take
+    for value, p := range waiting {
+        log.Printf("Waiting for in-flight request for value: %s", value.Value)
+        select {
+        case <-p.done:
+        case <-ctx.Done():
+            errs[value] = ctx.Err()
+            continue
+        }
+        if p.err != nil {
+            errs[value] = p.err
+            continue
+        }
+        tokens[value] = p.token
+    }
+
+    return tokens, errs
+}
+
+// tokenizeValueBatch tokenizes a batch of values and returns the tokens in the same order as the
+// values. Values of upsert fields are upserted, so values new to the vault get the token a
+// tokenize_table run would store; the rest are tokenized with a single Skyflow /tokenize call.
+func tokenizeValueBatch(ctx context.Context, batch []fieldValue, userEmail string) ([]string, error) {
+    tokens := make([]string, len(batch))
+    tokenizeIndexes := make([]int, 0, len(batch))
+    upsertIndexes := make(map[skyflowField][]int)
+    upsertFields := make([]skyflowField, 0)
+    for i, item := range batch {
+        if !isUpsertField(item.Field) {
+            tokenizeIndexes = append(tokenizeIndexes, i)
+            continue
+        }
+        if _, ok := upsertIndexes[item.Field]; !ok {
+            upsertFields = append(upsertFields, item.Field)
+        }
+        upsertIndexes[item.Field] = append(upsertIndexes[item.Field], i)
+    }
+
+    for _, field := range upsertFields {
+        if err := upsertValues(ctx, field, batch, upsertIndexes[field], tokens, userEmail); err != nil {
+            return nil, err
+        }
+    }
+    if len(tokenizeIndexes) == 0 {
+        return tokens, nil
     }
 
-    // We're the first request, get the token from Skyflow
-    log.Printf("Making Skyflow API call for value: %s", value)
-    
-    // Create request payload
     skyflowReq := TokenizeValueRequest{
-        TokenizationParameters: []struct {
-            Column string `json:"column"`
-            Table  string `json:"table"`
-            Value  string `json:"value"`
-        }{
-            {
-                Column: "pii",
-                Table:  os.Getenv("SKYFLOW_TABLE_NAME"),
-                Value:  value,
-            },
-        },
+        TokenizationParameters: make([]TokenizationParameter, len(tokenizeIndexes)),
+    }
+    for k, i := range tokenizeIndexes {
+        skyflowReq.TokenizationParameters[k] = TokenizationParameter{
+            Column: batch[i].Field.Field,
+            Table:  batch[i].Field.Table,
+            Value:  batch[i].Value,
+        }
     }
 
     // Make request
-    tokenResp, err := makeSkyflowAPIRequest[TokenizeValueRequest, TokenizeValueResponse]("/tokenize", skyflowReq, req.SessionUser, "")
+    tokenResp, err := makeSkyflowAPIRequest[TokenizeValueRequest, TokenizeValueResponse](ctx, "/tokenize", skyflowReq, userEmail, "")
+    if err != nil {
+        // A missing vault or table fails the calls; their values must not turn into empty tokens
+        return nil, err
+    }
+
+    if len(tokenResp.Records) != len(tokenizeIndexes) {
+        return nil, fmt.Errorf("expected %d records in response, got %d", len(tokenizeIndexes), len(tokenResp.Records))
+    }
+
+    for k, record := range tokenResp.Records {
+        tokens[tokenizeIndexes[k]] = record.Token
+    }
+    return tokens, nil
+}
+
+// upsertValues upserts the values at the given positions of a batch into a Skyflow field with
+// tokenization, keyed on the field, and sets their tokens at the same positions of tokens
+func upsertValues(ctx context.Context, field skyflowField, batch []fieldValue, indexes []int, tokens []string, userEmail string) error {
+    skyflowReq := TokenizeTableRequest{
+        Records:      make([]Record, len(indexes)),
+        Tokenization: true,
+        Upsert:       field.Field,
+    }
+    for k, i := range indexes {
+        skyflowReq.Records[k] = Record{Fields: map[string]string{field.Field: batch[i].Value}}
+    }
+
+    skyflowResp, err := makeSkyflowAPIRequest[TokenizeTableRequest, TokenizeTableResponse](ctx, "/"+field.Table, skyflowReq, userEmail, "")
     if err != nil {
-        if strings.Contains(err.Error(), "404") {
-            log.Printf("Skyflow returned 404 for value: %s, returning empty string", value)
-            return completeTokenPromise(promise, value, "", nil)
+        return fmt.Errorf("error upserting values into %s: %w", field, err)
+    }
+    if len(skyflowResp.Records) != len(indexes) {
+        return fmt.Errorf("expected %d records in response, got %d", len(indexes), len(skyflowResp.Records))
+    }
+
+    for k, record := range skyflowResp.Records {
+        token, ok := record.Tokens[field.Field]
+        if !ok {
+            return fmt.Errorf("no token for field %s in Skyflow response", field)
         }
-        return completeTokenPromise(promise, value, "", err)
+        tokens[indexes[k]] = token
     }
+    return nil
+}
+
+// handleTokenizeTable handles table tokenization requests. In async mode each call registers a
+// tokenize job and replies with its ID; otherwise the table is tokenized before replying.
+func handleTokenizeTable(ctx context.Context, req BigQueryRequest) (*BigQueryResponse, error) {
+    userContext, _ := req.userContext()
+    response := newResponseBuilder(req)
+    for i, call := range req.Calls {
+        params, err := parseTokenizeTableCall(ctx, call, userContext)
+        if err != nil {
+            response.setError(i, err)
+            continue
+        }
+
+        if userContext.asyncJobs() {
+            jobID, err := submitTokenizeJob(params, req.SessionUser)
+            if err != nil {
+                response.setError(i, err)
+                continue
+            }
+            response.setReply(i, jobID)
+            continue
+        }
 
-    if len(tokenResp.Records) == 0 {
-        return completeTokenPromise(promise, value, "", fmt.Errorf("no records in response"))
+        result, err := runTokenizeTable(ctx, params, req.SessionUser)
+        if err != nil {
+            response.setError(i, err)
+            continue
+        }
+        response.setReply(i, result.message())
     }
+    return response.build()
+}
+
+// tokenizeTableParams holds the validated arguments of a tokenize_table call
+type tokenizeTableParams struct {
+    Table          tableRef  `json:"table"`
+    Columns        []string  `json:"columns"`
+    Destination    *tableRef  `json:"destination,omitempty"` // Table to write the tokenized copy to; nil updates Table in place
+    TouchUpdatedAt bool       `json:"touch_updated_at"`      // Set updated_at on tokenized rows
+    Filter         *rowFilter `json:"filter,omitempty"`      // Rows to tokenize; nil for the whole table
+}
+
+// tokenizeTableResult summarizes a tokenize_table run
+type tokenizeTableResult struct {
+    Columns       []string       `json:"columns"`
+    Destination   string         `json:"destination,omitempty"`
+    Tokenized     int            `json:"tokenized_values"`
+    SkippedTokens int            `json:"skipped_tokens"`         // Values left as they were because they are already tokens
+    ShortValues   map[string]int `json:"short_values,omitempty"` // Number of short values per short value policy applied
+}
 
-    return completeTokenPromise(promise, value, tokenResp.Records[0].Token, nil)
+// message returns the reply for a completed tokenize_table call
+func (r *tokenizeTableResult) message() string {
+    message := fmt.Sprintf("Successfully tokenized %d values in columns: %s (skipped %d values that were already tokens)",
+        r.Tokenized, strings.Join(r.Columns, ","), r.SkippedTokens)
+    if len(r.ShortValues) > 0 {
+        treatments := make([]string, 0, len(r.ShortValues))
+        for _, action := range []string{ShortValueTokenize, ShortValuePad, ShortValueNull, ShortValueRedact} {
+            if count := r.ShortValues[action]; count > 0 {
+                treatments = append(treatments, fmt.Sprintf("%s: %d", action, count))
+            }
+        }
+        message += fmt.Sprintf(", short values (%s)", strings.Join(treatments, ", "))
+    }
+    if r.Destination != "" {
+        message += fmt.Sprintf(", written to %s", r.Destination)
+    }
+    return message
 }
 
-// handleTokenizeTable handles table tokenization requests
-func handleTokenizeTable(req BigQueryRequest) (*BigQueryResponse, error) {
-    tableName, ok := req.Calls[0][0].(string)
+// addCheckpoint adds the counts of a column's checkpoint to the result
+func (r *tokenizeTableResult) addCheckpoint(checkpoint *columnCheckpoint) {
+    r.Tokenized += checkpoint.Count
+    r.SkippedTokens += checkpoint.Skipped
+    for action, count := range checkpoint.ShortValues {
+        if r.ShortValues == nil {
+            r.ShortValues = make(map[string]int)
+        }
+        r.ShortValues[action] += count
+    }
+}
+
+// parseTokenizeTableCall validates the arguments of a tokenize_table call. An optional third
+// argument names a destination table for a tokenized copy of the table. A row filter, and
+// touch_updated_at to set updated_at on tokenized rows, may be set in the user defined context.
+func parseTokenizeTableCall(ctx context.Context, call []interface{}, userContext UserDefinedContext) (*tokenizeTableParams, error) {
+    if len(call) < 2 {
+        return nil, badRequest("expected table name and columns arguments")
+    }
+
+    tableName, ok := call[0].(string)
     if !ok {
-        return nil, fmt.Errorf("invalid table name format")
+        return nil, badRequest("invalid table name format")
     }
 
-    columns, ok := req.Calls[0][1].(string)
+    columns, ok := call[1].(string)
     if !ok {
-        return nil, fmt.Errorf("invalid columns format")
+        return nil, badRequest("invalid columns format")
     }
 
     if tableName == "" || columns == "" {
-        return nil, fmt.Errorf("table name and columns are required")
+        return nil, badRequest("table name and columns are required")
     }
 
-    // Split columns and build query
-    columnList := strings.Split(columns, ",")
-    for i, col := range columnList {
-        columnList[i] = strings.TrimSpace(col)
-    }
-    query := fmt.Sprintf("SELECT %s FROM `%s`", strings.Join(columnList, ", "), tableName)
-    log.Printf("Executing query: %s", query)
-    bqData, err := queryBigQuery(query)
+    table, err := parseTableName(tableName)
     if err != nil {
-        return nil, fmt.Errorf("error querying BigQuery: %v", err)
+        return nil, err
     }
 
-    // Get batch sizes
-    skyflowBatchSize := getBatchSize("SKYFLOW_INSERT_BATCH_SIZE", 25)
-    bigqueryBatchSize := getBatchSize("BIGQUERY_UPDATE_BATCH_SIZE", 1000)
-
-    // Initialize column token maps
-    columnTokenMaps := make(map[string]map[string]string) // column -> (original -> token)
+    // Parse columns and check them against the table schema before reading any data
+    columnList, err := parseColumnList(columns)
+    if err != nil {
+        return nil, err
+    }
+    metadata, err := getTableMetadata(ctx, table)
+    if err != nil {
+        return nil, err
+    }
+    columnList, err = validateColumns(metadata.Schema, table, columnList)
+    if err != nil {
+        return nil, err
+    }
     for _, column := range columnList {
-        columnTokenMaps[column] = make(map[string]string)
+        // Arrays can't hold NULL, so array elements can't be replaced with NULL
+        path, err := parseColumnPath(column)
+        if err != nil {
+            return nil, err
+        }
+        policy, err := shortValuePolicyFor(table, column)
+        if err != nil {
+            return nil, err
+        }
+        if path.isArrayElement() && policy.Action == ShortValueNull {
+            return nil, badRequest("column %s holds ARRAY elements, which can't be set to NULL; choose another short value policy", column)
+        }
+    }
+    filter, err := parseRowFilter(userContext, table, metadata)
+    if err != nil {
+        return nil, err
     }
 
-    // Prepare records for batch processing
-    records := make([]Record, 0)
-    for _, row := range bqData {
-        for colIdx, column := range columnList {
-            value := row[colIdx]
-            strValue := fmt.Sprintf("%v", value)
-            if value == nil || strValue == "" {
-                continue
-            }
+    params := &tokenizeTableParams{
+        Table:          table,
+        Columns:        columnList,
+        TouchUpdatedAt: userContext.touchUpdatedAt(),
+        Filter:         filter,
+    }
+    if params.TouchUpdatedAt {
+        if !hasUpdatedAtColumn(metadata.Schema) {
+            return nil, badRequest("touch_updated_at is set but table %s has no TIMESTAMP updated_at column", table)
+        }
+        if filter != nil && strings.EqualFold(filter.WatermarkColumn, "updated_at") {
+            // Touching the watermark column would make the next run read every tokenized row again
+            return nil, badRequest("touch_updated_at can't be set when updated_at is the watermark column")
+        }
+    }
 
-            // Skip values that don't meet minimum length requirement
-            if len(strValue) < minPiiLength {
-                log.Printf("Skipping value with length %d for column %s (minimum required: %d)",
-                    len(strValue), column, minPiiLength)
-                continue
+    if len(call) > 2 && call[2] != nil {
+        destinationName, ok := call[2].(string)
+        if !ok {
+            return nil, badRequest("invalid destination table format")
+        }
+        if destinationName != "" {
+            destination, err := parseTableName(destinationName)
+            if err != nil {
+                return nil, err
             }
-
-            records = append(records, Record{
-                Fields: map[string]string{
-                    "pii": strValue,
-                },
-                Table: column, // Use column name to track which column this record belongs to
-            })
+            if destination == table {
+                return nil, badRequest("destination table must differ from the source table")
+            }
+            params.Destination = &destination
         }
     }
 
-    // Process records in batches
-    processor := func(batch []Record) ([]Record, error) {
-        if err := processBatch(batch, columnTokenMaps, req.SessionUser); err != nil {
-            return nil, fmt.Errorf("error processing batch: %v", err)
+    return params, nil
+}
+
+// runTokenizeTable tokenizes the columns of a table. Each column, or group of columns mapped to
+// the same Skyflow table, is read in ascending value order and tokenized in chunks; every chunk's
+// tokens are written to the run's staging table and checkpointed before the next chunk is read.
+// Once a column is fully staged it is merged into the table in one statement. With a destination, the source is left as it is and, once every column
+// is staged, a copy of it with the tokens applied replaces the destination's contents. With a row
+// filter only matching rows are read and updated, and a destination copy is appended to instead.
+// Repeating an interrupted call resumes from the last checkpoint, so values are never sent to
+// Skyflow twice and merged columns are never tokenized again.
+func runTokenizeTable(ctx context.Context, params *tokenizeTableParams, userEmail string) (*tokenizeTableResult, error) {
+    table := params.Table
+    runKey := tokenizeRunKey(params)
+    staging := stagingTableFor(table, runKey)
+    store := getCheckpointStore()
+
+    // Only one run per table and column set may make progress at a time, on any instance. The
+    // run's lease in the checkpoint store is renewed by monitorJobs while the run is active here.
+    runConflict := &requestError{
+        status: http.StatusConflict,
+        err:    fmt.Errorf("columns %s of table %s are already being tokenized", strings.Join(params.Columns, ","), table),
+    }
+    if _, running := activeRuns.LoadOrStore(runKey, struct{}{}); running {
+        return nil, runConflict
+    }
+    defer activeRuns.Delete(runKey)
+    owner := getLeaseOwner()
+    leased, err := store.Acquire(ctx, runKey, owner, time.Now().UTC())
+    if err != nil {
+        // Nothing was done yet, so the call can safely be retried
+        return nil, unavailable(fmt.Errorf("error taking lease of tokenize run %s: %v", runKey, err))
+    }
+    if !leased {
+        return nil, runConflict
+    }
+    defer func() {
+        if err := store.Release(context.WithoutCancel(ctx), runKey, owner); err != nil {
+            log.Printf("[WARN] Failed to release lease of tokenize run %s, it expires once stale: %v", runKey, err)
         }
-        return batch, nil
+    }()
+
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return nil, err
+    }
+    defer bq.Close()
+    bq.enableStorageRead(ctx)
+
+    result := &tokenizeTableResult{Columns: params.Columns}
+    if params.Destination != nil {
+        result.Destination = params.Destination.String()
     }
 
-    _, err = batchProcessor(records, skyflowBatchSize, processor)
+    condition, mark, hasRows, err := resolveRowCondition(ctx, bq, runKey, params)
     if err != nil {
         return nil, err
     }
+    if !hasRows {
+        return result, nil
+    }
 
-    // Process updates in batches
-    for column, valueTokenMap := range columnTokenMaps {
-        if len(valueTokenMap) == 0 {
+    columnCheckpoints, err := store.Load(ctx, runKey)
+    if err != nil {
+        return nil, err
+    }
+    created, err := bq.ensureStagingTable(ctx, staging)
+    if err != nil {
+        return nil, err
+    }
+    if created && len(columnCheckpoints) > 0 {
+        // The staging table expired or was deleted, so unmerged progress is lost
+        log.Printf("[WARN] Staging table %s for run %s was recreated, restarting unmerged columns", staging, runKey)
+        for column, checkpoint := range columnCheckpoints {
+            if checkpoint.Phase != PhaseMerged {
+                delete(columnCheckpoints, column)
+            }
+        }
+    }
+
+    for _, group := range groupColumns(table, params.Columns) {
+        // Columns tokenized together share a checkpoint
+        key := strings.Join(group, ",")
+        checkpoint, ok := columnCheckpoints[key]
+        if !ok {
+            checkpoint = &columnCheckpoint{Column: key, Phase: PhaseStaging}
+        }
+
+        switch checkpoint.Phase {
+        case PhaseMerged:
+            log.Printf("Columns %s already tokenized in run %s (%d values), skipping", key, runKey, checkpoint.Count)
+            result.addCheckpoint(checkpoint)
             continue
+        case PhaseStaging:
+            if checkpoint.Count > 0 {
+                log.Printf("Resuming columns %s in run %s after %d values", key, runKey, checkpoint.Count)
+            }
+            if err := stageColumns(ctx, bq, table, staging, condition, runKey, group, checkpoint, userEmail); err != nil {
+                return nil, err
+            }
         }
 
-        // Convert map to slices for batch processing
-        type updatePair struct {
-            original string
-            token    string
+        result.addCheckpoint(checkpoint)
+        if params.Destination != nil {
+            // The tokens are applied to the copy once every column is staged
+            continue
         }
-        pairs := make([]updatePair, 0, len(valueTokenMap))
-        for origValue, tokenVal := range valueTokenMap {
-            pairs = append(pairs, updatePair{origValue, tokenVal})
+
+        for _, column := range group {
+            if err := bq.mergeStagedColumn(ctx, table, staging, column, condition, params.TouchUpdatedAt); err != nil {
+                return nil, err
+            }
+        }
+        if err := saveCheckpoint(ctx, runKey, checkpoint, PhaseMerged); err != nil {
+            return nil, err
         }
+    }
+
+    if params.Destination != nil {
+        // An appended copy commits the watermark along with the rows where the store allows it,
+        // so a failed commit can't make a repeated run append the rows again
+        var commit *sqlStatement
+        if mark != nil {
+            commit = watermarkCommitStatement(runKey, mark)
+        }
+        if err := bq.writeTokenizedCopy(ctx, table, staging, *params.Destination, params.Columns, condition, params.TouchUpdatedAt, commit); err != nil {
+            return nil, err
+        }
+        if commit != nil {
+            mark = nil
+        }
+    }
+    if mark != nil {
+        if err := commitWatermark(ctx, runKey, mark); err != nil {
+            return nil, err
+        }
+    }
 
-        // Process updates in batches
-        processor := func(batch []updatePair) ([]updatePair, error) {
-            cases := make([]string, 0, len(batch))
-            for _, pair := range batch {
-                cases = append(cases, fmt.Sprintf("WHEN %s = '%s' THEN '%s'",
-                    column,
-                    strings.ReplaceAll(pair.original, "'", "\\'"), // Escape single quotes
-                    pair.token))
+    // The run is complete, so its checkpoints and staging table are no longer needed
+    if err := store.Clear(ctx, runKey); err != nil {
+        log.Printf("[WARN] Failed to clear checkpoints for run %s: %v", runKey, err)
+    }
+    bq.deleteStagingTable(ctx, staging)
+
+    return result, nil
+}
+
+// stageColumns tokenizes the values of a group of columns after the checkpoint's cursor and
+// writes them to the staging table, checkpointing after every chunk. A single column is read as
+// its distinct values, and a group of columns as the distinct combinations of their values in a
+// row. Values are streamed from BigQuery while earlier chunks are being tokenized;
+// TOKENIZE_READ_BUFFER chunks are read ahead at most.
+func stageColumns(ctx context.Context, bq *bigQueryClient, table tableRef, staging tableRef, condition *rowCondition, runKey string, columns []string, checkpoint *columnCheckpoint, userEmail string) error {
+    chunkSize := getBatchSize("TOKENIZE_CHECKPOINT_SIZE", 10000)
+    bufferSize := getBatchSize("TOKENIZE_READ_BUFFER", 2)
+    fields := make(map[string]skyflowField, len(columns))
+    policies := make(map[string]shortValuePolicy, len(columns))
+    for _, column := range columns {
+        policy, err := shortValuePolicyFor(table, column)
+        if err != nil {
+            return err
+        }
+        fields[column] = skyflowFieldFor(table, column)
+        policies[column] = policy
+        log.Printf("Tokenizing column %s into Skyflow field %s (short values under %d characters: %s)",
+            column, fields[column], policy.MinLength, policy.Action)
+    }
+
+    var it *bigquery.RowIterator
+    var err error
+    if len(columns) == 1 {
+        it, err = bq.readDistinctValues(ctx, table, columns[0], checkpoint.Cursor, condition)
+    } else {
+        it, err = bq.readDistinctRows(ctx, table, columns, checkpoint.Cursor, condition)
+    }
+    if err != nil {
+        return fmt.Errorf("error querying BigQuery: %w", err)
+    }
+    if it.IsAccelerated() {
+        log.Printf("Streaming values of columns %s through the Storage Read API", checkpoint.Column)
+    }
+
+    // Stop the reader if staging fails part way
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    for chunk := range streamValueChunks(ctx, it, chunkSize, bufferSize) {
+        if chunk.err != nil {
+            return chunk.err
+        }
+
+        // Rows of a group start with their sort key
+        rows := chunk.rows
+        if len(columns) > 1 {
+            rows = make([][]string, len(chunk.rows))
+            for i, row := range chunk.rows {
+                rows[i] = row[1:]
+            }
+        }
+        counts, err := stageChunk(ctx, bq, staging, columns, fields, policies, rows, userEmail)
+        if err != nil {
+            return err
+        }
+        checkpoint.Cursor = chunk.rows[len(chunk.rows)-1][0]
+        checkpoint.Count += counts.Tokenized
+        checkpoint.Skipped += counts.Skipped
+        for action, count := range counts.ShortValues {
+            if checkpoint.ShortValues == nil {
+                checkpoint.ShortValues = make(map[string]int)
             }
+            checkpoint.ShortValues[action] += count
+        }
+        if err := saveCheckpoint(ctx, runKey, checkpoint, PhaseStaging); err != nil {
+            return err
+        }
+    }
+
+    return saveCheckpoint(ctx, runKey, checkpoint, PhaseStaged)
+}
+
+// chunkCounts counts the treatment of the values of a staged chunk
+type chunkCounts struct {
+    Tokenized   int            // Values tokenized by Skyflow
+    Skipped     int            // Values skipped as existing tokens
+    ShortValues map[string]int // Short values per short value policy applied
+}
 
-            // Build and execute update query for this batch
-            updateQuery := fmt.Sprintf(`
-UPDATE %s
-SET 
-    %s = CASE %s ELSE %s END,
-    updated_at = CURRENT_TIMESTAMP()
-WHERE %s IN (%s)`,
-                tableName,
-                column,
-                strings.Join(cases, " "),
-                column,
-                column,
-                strings.Join(buildOriginalValuesList(
-                    mapFromSlices(
-                        func() ([]string, []string) {
-                            orig := make([]string, len(batch))
-                            tokens := make([]string, len(batch))
-                            for i, pair := range batch {
-                                orig[i] = pair.original
-                                tokens[i] = pair.token
-                            }
-                            return orig, tokens
-                        }())), ","))
-
-            log.Printf("Executing batch update query for column %s (%d values)", column, len(batch))
-            if err := executeUpdate(updateQuery); err != nil {
-                return nil, fmt.Errorf("error updating table: %v", err)
+// rowRecord holds the values of one row that go into one Skyflow record, keyed by column
+type rowRecord map[string]string
+
+// stageChunk tokenizes a chunk of rows of a group of columns into their Skyflow fields and writes
+// the tokens to the staging table. Each row holds one value per column, empty if it has none, and
+// becomes one Skyflow record filling the fields of its values. Short values are treated according
+// to their column's policy: padded values are tokenized and staged under their original value,
+// and values replaced with NULL or a redaction marker are staged without a Skyflow call.
+func stageChunk(ctx context.Context, bq *bigQueryClient, staging tableRef, columns []string, fields map[string]skyflowField, policies map[string]shortValuePolicy, rows [][]string, userEmail string) (chunkCounts, error) {
+    skyflowBatchSize := getBatchSize("SKYFLOW_INSERT_BATCH_SIZE", 25)
+    columnTokenMaps := make(map[string]map[string]string, len(columns)) // column -> (original -> token)
+    padded := make(map[string]map[string]string, len(columns))          // column -> (padded value -> original value)
+    short := make(map[string]map[string]bool, len(columns))             // column -> short values seen
+    for _, column := range columns {
+        columnTokenMaps[column] = make(map[string]string)
+        padded[column] = make(map[string]string)
+        short[column] = make(map[string]bool)
+    }
+    counts := chunkCounts{ShortValues: make(map[string]int)}
+
+    // Prepare one record per row
+    records := make([]rowRecord, 0, len(rows))
+    staged := make([]stagedToken, 0)
+    for _, row := range rows {
+        record := make(rowRecord, len(columns))
+        for i, column := range columns {
+            value := row[i]
+            if value == "" {
+                continue
+            }
+            sent := value
+            policy := policies[column]
+            if policy.isShort(value) {
+                // A value shared by several rows is counted and staged once
+                first := !short[column][value]
+                if first {
+                    short[column][value] = true
+                    counts.ShortValues[policy.Action]++
+                }
+                switch policy.Action {
+                case ShortValuePad:
+                    sent = policy.pad(value)
+                    padded[column][sent] = value
+                case ShortValueNull:
+                    if first {
+                        staged = append(staged, stagedToken{ColumnName: column, Original: value, Token: nullToken})
+                    }
+                    continue
+                case ShortValueRedact:
+                    if first {
+                        staged = append(staged, stagedToken{ColumnName: column, Original: value, Token: policy.Marker})
+                    }
+                    continue
+                case ShortValueFail:
+                    return chunkCounts{}, badRequest("column %s has a value of %d characters, shorter than the minimum of %d",
+                        column, utf8.RuneCountInString(value), policy.MinLength)
+                }
             }
-            return batch, nil
+            record[column] = sent
         }
+        if len(record) > 0 {
+            records = append(records, record)
+        }
+    }
 
-        _, err = batchProcessor(pairs, bigqueryBatchSize, processor)
+    // Process records in concurrent batches, each filling its own token maps
+    var mu sync.Mutex
+    processor := func(ctx context.Context, batch []rowRecord) ([]rowRecord, error) {
+        batchTokenMaps := make(map[string]map[string]string, len(columns))
+        for _, column := range columns {
+            batchTokenMaps[column] = make(map[string]string)
+        }
+        batchSkipped, err := processBatch(ctx, batch, fields, batchTokenMaps, userEmail)
         if err != nil {
-            return nil, err
+            return nil, fmt.Errorf("error processing batch: %w", err)
         }
+        mu.Lock()
+        defer mu.Unlock()
+        for column, tokens := range batchTokenMaps {
+            for original, token := range tokens {
+                columnTokenMaps[column][original] = token
+            }
+        }
+        counts.Skipped += batchSkipped
+        return batch, nil
+    }
+    concurrency := getBatchSize("SKYFLOW_INSERT_CONCURRENCY", 4)
+    limiter := sharedRateLimiter("SKYFLOW_INSERT_RATE_LIMIT")
+    if _, err := concurrentBatchProcessor(ctx, records, skyflowBatchSize, concurrency, limiter, processor); err != nil {
+        return chunkCounts{}, err
     }
 
-    // Calculate total number of tokenized values
-    totalTokenized := 0
-    for _, valueTokenMap := range columnTokenMaps {
-        totalTokenized += len(valueTokenMap)
+    for _, column := range columns {
+        for original, token := range columnTokenMaps[column] {
+            if value, ok := padded[column][original]; ok {
+                original = value
+            }
+            staged = append(staged, stagedToken{ColumnName: column, Original: original, Token: token})
+        }
+        counts.Tokenized += len(columnTokenMaps[column])
+    }
+    if len(staged) == 0 {
+        return counts, nil
     }
 
-    return &BigQueryResponse{
-        Replies: []interface{}{fmt.Sprintf("Successfully tokenized %d values in columns: %s", totalTokenized, columns)},
-    }, nil
+    log.Printf("Loading %d token pairs for columns %s into staging table %s", len(staged), strings.Join(columns, ","), staging)
+    if err := bq.loadStagingTable(ctx, staging, staged); err != nil {
+        return chunkCounts{}, err
+    }
+    return counts, nil
+}
+
+// saveCheckpoint records a column's progress in the checkpoint store
+func saveCheckpoint(ctx context.Context, runKey string, checkpoint *columnCheckpoint, phase string) error {
+    checkpoint.Phase = phase
+    checkpoint.UpdatedAt = time.Now().UTC()
+    if err := getCheckpointStore().Save(ctx, runKey, checkpoint); err != nil {
+        return fmt.Errorf("error saving checkpoint for column %s: %v", checkpoint.Column, err)
+    }
+    return nil
+}
+
+// processBatch handles a batch of records for tokenization. Each record holds the values of a
+// row's columns, all mapped to fields of one Skyflow table. Values that are already tokens are
+// left out, and the records are grouped per Skyflow table so that one insert fills the fields of
+// each row. Records of upsert fields are upserted separately, keyed on their field. Returns the
+// number of values skipped.
+func processBatch(ctx context.Context, batch []rowRecord, columnFields map[string]skyflowField, columnTokenMaps map[string]map[string]string, userEmail string) (int, error) {
+    // Skip values that are already tokens
+    type recordValue struct {
+        record int
+        column string
+    }
+    values := make([]string, 0, len(batch))
+    positions := make([]recordValue, 0, len(batch))
+    for i, record := range batch {
+        for column, value := range record {
+            values = append(values, value)
+            positions = append(positions, recordValue{record: i, column: column})
+        }
+    }
+    isToken, err := getTokenRecognizer().recognize(ctx, values, userEmail)
+    if err != nil {
+        return 0, err
+    }
+    remaining := make([]rowRecord, len(batch))
+    for i, record := range batch {
+        remaining[i] = make(rowRecord, len(record))
+    }
+    skipped := 0
+    for i, position := range positions {
+        if isToken[i] {
+            skipped++
+            continue
+        }
+        remaining[position.record][position.column] = values[i]
+    }
+    if skipped > 0 {
+        log.Printf("Skipping %d values that are already tokens", skipped)
+    }
+
+    // Group the remaining records by Skyflow table and upsert field
+    type insertGroup struct {
+        table  string
+        upsert string
+    }
+    groupRecords := make(map[insertGroup][]rowRecord)
+    groups := make([]insertGroup, 0, 1)
+    for _, record := range remaining {
+        var group insertGroup
+        for column := range record {
+            field := columnFields[column]
+            group.table = field.Table
+            if isUpsertField(field) {
+                group.upsert = field.Field
+            }
+        }
+        if group.table == "" {
+            continue
+        }
+        if _, ok := groupRecords[group]; !ok {
+            groups = append(groups, group)
+        }
+        groupRecords[group] = append(groupRecords[group], record)
+    }
+
+    for _, group := range groups {
+        if err := insertRecords(ctx, group.table, group.upsert, groupRecords[group], columnFields, columnTokenMaps, userEmail); err != nil {
+            return 0, err
+        }
+    }
+    return skipped, nil
 }
 
-// processBatch handles a batch of records for tokenization
-func processBatch(batch []Record, columnTokenMaps map[string]map[string]string, userEmail string) error {
+// insertRecords inserts records into a Skyflow table with tokenization and maps the token of each
+// field of a record back to its column. With an upsert field, records whose value already exists
+// in the vault reuse that record and its token.
+func insertRecords(ctx context.Context, table string, upsert string, records []rowRecord, columnFields map[string]skyflowField, columnTokenMaps map[string]map[string]string, userEmail string) error {
     skyflowReq := TokenizeTableRequest{
-        Records:      batch,
+        Records:      make([]Record, len(records)),
         Tokenization: true,
+        Upsert:       upsert,
+    }
+    for i, record := range records {
+        fields := make(map[string]string, len(record))
+        for column, value := range record {
+            fields[columnFields[column].Field] = value
+        }
+        skyflowReq.Records[i] = Record{Fields: fields, Table: table}
     }
 
     // Make request
-    skyflowResp, err := makeSkyflowAPIRequest[TokenizeTableRequest, struct {
-        Records []struct {
-            SkyflowID string            `json:"skyflow_id"`
-            Tokens    map[string]string `json:"tokens"`
-        } `json:"records"`
-    }]("/"+os.Getenv("SKYFLOW_TABLE_NAME"), skyflowReq, userEmail, "")
+    skyflowResp, err := makeSkyflowAPIRequest[TokenizeTableRequest, TokenizeTableResponse](ctx, "/"+table, skyflowReq, userEmail, "")
     if err != nil {
-        return fmt.Errorf("error making request: %v", err)
+        return fmt.Errorf("error making request: %w", err)
+    }
+    if len(skyflowResp.Records) != len(records) {
+        return fmt.Errorf("Skyflow returned %d records for %d inserted", len(skyflowResp.Records), len(records))
     }
 
     // Map tokens back to their respective columns
     for i, record := range skyflowResp.Records {
-        if tokenValue, ok := record.Tokens["pii"]; ok {
-            column := batch[i].Table
-            originalValue := batch[i].Fields["pii"]
-            columnTokenMaps[column][originalValue] = tokenValue
+        for column, value := range records[i] {
+            if token, ok := record.Tokens[columnFields[column].Field]; ok {
+                columnTokenMaps[column][value] = token
+            }
         }
     }
 
@@ -618,7 +1343,7 @@ func processBatch(batch []Record, columnTokenMaps map[string]map[string]string,
 }
 
 // handleDetokenize handles detokenization requests
-func handleDetokenize(req BigQueryRequest, userRoles []string) (*BigQueryResponse, error) {
+func handleDetokenize(ctx context.Context, req BigQueryRequest, userRoles []string) (*BigQueryResponse, error) {
     // Map user's Google roles to a Skyflow role ID
     roleID, hasRole := hasRequiredRole(userRoles, []string{})
     log.Printf("[INFO] Detokenize request from user with roles: %v, mapped to Skyflow role: %s", userRoles, roleID)
@@ -639,14 +1364,19 @@ func handleDetokenize(req BigQueryRequest, userRoles []string) (*BigQueryRespons
     }
     roleConfigCache.RUnlock()
     batchSize := getBatchSize("SKYFLOW_DETOKENIZE_BATCH_SIZE", 25)
+    response := newResponseBuilder(req)
+    padded := padLengths()
 
-    // Process tokens in batches
-    processor := func(batch [][]interface{}) ([]interface{}, error) {
+    // Process tokens in concurrent batches
+    processor := func(ctx context.Context, batch [][]interface{}) ([]detokenizeResult, error) {
+        results := make([]detokenizeResult, len(batch))
         detokenizeReq := DetokenizeRequest{
-            DetokenizationParameters: make([]TokenParam, len(batch)),
+            DetokenizationParameters: make([]TokenParam, 0, len(batch)),
         }
+        requestIndexes := make([]int, 0, len(batch)) // position in batch of each token sent to Skyflow
 
         for j, call := range batch {
+            // NULL and empty tokens detokenize to NULL without a Skyflow call
             if len(call) == 0 {
                 continue
             }
@@ -657,6 +1387,12 @@ func handleDetokenize(req BigQueryRequest, userRoles []string) (*BigQueryRespons
             
             if tokenVal, ok := call[0].(string); ok {
                 tokenStr = tokenVal
+            } else if call[0] != nil {
+                results[j].err = badRequest("invalid token format: expected string")
+                continue
+            }
+            if tokenStr == "" {
+                continue
             }
             
             if len(call) > 1 {
@@ -665,47 +1401,75 @@ func handleDetokenize(req BigQueryRequest, userRoles []string) (*BigQueryRespons
                 }
             }
             
-            detokenizeReq.DetokenizationParameters[j] = TokenParam{
+            detokenizeReq.DetokenizationParameters = append(detokenizeReq.DetokenizationParameters, TokenParam{
                 Token:     tokenStr,
                 Redaction: redaction,
-            }
+            })
+            requestIndexes = append(requestIndexes, j)
+        }
+        if len(requestIndexes) == 0 {
+            return results, nil
         }
 
         // Make Skyflow request
         log.Printf("[INFO] Making request to Skyflow API with %d tokens using role ID: %s", len(detokenizeReq.DetokenizationParameters), roleID)
-        resp, err := makeSkyflowAPIRequest[DetokenizeRequest, DetokenizeResponse]("/detokenize", detokenizeReq, req.SessionUser, roleID)
+        resp, err := makeSkyflowAPIRequest[DetokenizeRequest, DetokenizeResponse](ctx, "/detokenize", detokenizeReq, req.SessionUser, roleID)
         if err != nil {
             log.Printf("[ERROR] Skyflow request failed: %v", err)
-            return make([]interface{}, len(batch)), nil
+            for _, j := range requestIndexes {
+                results[j].err = err
+            }
+            return results, nil
         }
 
         // Map responses back to original order
-        results := make([]interface{}, len(batch))
-        for j := range batch {
-            if j < len(resp.Records) {
-                if resp.Records[j].Error != nil {
-                    log.Printf("[ERROR] Skyflow error for token %s: %v", detokenizeReq.DetokenizationParameters[j].Token, resp.Records[j].Error)
-                } else {
-                    log.Printf("[DEBUG] Skyflow response for token %s: value=%s, type=%s", 
-                        detokenizeReq.DetokenizationParameters[j].Token,
-                        resp.Records[j].Value,
-                        resp.Records[j].ValueType)
-                    results[j] = resp.Records[j].Value
-                }
+        for k, j := range requestIndexes {
+            token := detokenizeReq.DetokenizationParameters[k].Token
+            if k >= len(resp.Records) {
+                results[j].err = fmt.Errorf("no record in Skyflow response for token %s", token)
+                continue
+            }
+            if resp.Records[k].Error != nil {
+                log.Printf("[ERROR] Skyflow error for token %s: %v", token, resp.Records[k].Error)
+                results[j].err = badRequest("error detokenizing token %s: %v", token, resp.Records[k].Error)
+                continue
             }
+            log.Printf("[DEBUG] Skyflow response for token %s: value=%s, type=%s", 
+                token,
+                resp.Records[k].Value,
+                resp.Records[k].ValueType)
+            results[j].value = unpadValue(resp.Records[k].Value, padded)
         }
         return results, nil
     }
 
-    results, err := batchProcessor(req.Calls, batchSize, processor)
+    concurrency := getBatchSize("SKYFLOW_DETOKENIZE_CONCURRENCY", 4)
+    limiter := sharedRateLimiter("SKYFLOW_DETOKENIZE_RATE_LIMIT")
+    results, err := concurrentBatchProcessor(ctx, req.Calls, batchSize, concurrency, limiter, processor)
     if err != nil {
         return nil, err
     }
 
-    return &BigQueryResponse{Replies: results}, nil
+    for i, result := range results {
+        if result.err != nil {
+            response.setError(i, result.err)
+            continue
+        }
+        response.setReply(i, result.value)
+    }
+
+    return response.build()
+}
+
+// detokenizeResult holds the outcome of detokenizing a single call
+type detokenizeResult struct {
+    value interface{}
+    err   error
 }
 
-// getUserRoles fetches user roles from Cloud Resource Manager
+// getUserRoles fetches user roles from the IAM policies of the project, its folders and its
+// organization. Roles granted to the user, the service account, its email domain or a group it
+// belongs to all count, unless deny policies deny all of their permissions.
 func getUserRoles(ctx context.Context, email string) ([]string, error) {
     // Get project ID from environment variable
     projectID := os.Getenv("PROJECT_ID")
@@ -713,61 +1477,100 @@ func getUserRoles(ctx context.Context, email string) ([]string, error) {
         return nil, fmt.Errorf("PROJECT_ID environment variable not set")
     }
 
-    // Initialize the Cloud Resource Manager client with default credentials
-    client, err := cloudresourcemanager.NewService(ctx)
+    // Get the IAM policies of the resource hierarchy
+    policy, err := getEffectivePolicy(ctx, projectID)
     if err != nil {
-        return nil, fmt.Errorf("failed to create Cloud Resource Manager client: %v", err)
+        return nil, err
     }
 
-    // Get IAM Policy
-    policy, err := client.Projects.GetIamPolicy(projectID, &cloudresourcemanager.GetIamPolicyRequest{}).Context(ctx).Do()
+    // Group memberships are only looked up if a policy names a group
+    identities, err := identityMembers(ctx, email, policy.grantsToGroups())
     if err != nil {
-        return nil, fmt.Errorf("failed to get IAM policy: %v", err)
+        return nil, fmt.Errorf("failed to resolve group memberships: %w", err)
     }
 
-    // Find roles for the user
-    roles := make([]string, 0, len(policy.Bindings))
-    for _, binding := range policy.Bindings {
+    roles := grantedRoles(policy.Bindings, identities)
+    return removeDeniedRoles(ctx, roles, identities, policy.DenyRules)
+}
+
+// grantedRoles returns the roles bound anywhere in the hierarchy to one of the identity's IAM
+// members (see identityMembers), i.e. to the user directly or through their domain or groups
+func grantedRoles(bindings []iamBinding, identities map[string]bool) []string {
+    roles := make([]string, 0, len(bindings))
+    found := make(map[string]bool)
+    for _, binding := range bindings {
+        if found[binding.Role] {
+            continue
+        }
         for _, member := range binding.Members {
-            if strings.EqualFold(member, fmt.Sprintf("user:%s", email)) {
+            if identities[strings.ToLower(member)] {
                 roles = append(roles, binding.Role)
+                found[binding.Role] = true
+                break
             }
         }
     }
-
-    return roles, nil
+    return roles
 }
 
-// getBearerToken gets a bearer token from Skyflow with optional role scope
-func getBearerToken(userEmail string, roleID string, userRoles []string) (string, error) {
-    mutex.Lock()
-    defer mutex.Unlock()
-
-    // Generate cache key including user's Google roles
-    rolesStr := strings.Join(userRoles, ",")
-    key := userEmail
-    if roleID != "" {
-        key = fmt.Sprintf("%s:%s:%s", roleID, userEmail, rolesStr)
-    }
+// getBearerToken gets a bearer token from Skyflow with optional role scope. Tokens are cached
+// until they expire and refreshed in the background shortly before. Concurrent requests for the
+// same cache key share one token exchange; other keys and cache hits never wait for it.
+func getBearerToken(ctx context.Context, userEmail string, roleID string, userRoles []string) (string, error) {
+    key := bearerTokenKey(userEmail, roleID, userRoles)
     log.Printf("[DEBUG] Getting bearer token for cache key: %s", key)
 
     // Check cache
-    if token, ok := bearerTokenCache.Load(key); ok {
+    cache := getBearerTokenCache()
+    if token, refresh, ok := cache.get(key); ok {
         log.Printf("[DEBUG] Found cached bearer token for key: %s", key)
-        return token.(string), nil
+        if refresh {
+            go refreshBearerToken(key, userEmail, roleID)
+        }
+        return token, nil
     }
     log.Printf("[DEBUG] No cached bearer token found, requesting new token")
 
+    return fetchSharedBearerToken(ctx, key, userEmail, roleID)
+}
+
+// bearerTokenKey returns the cache key of a bearer token, including the user's Google roles
+func bearerTokenKey(userEmail string, roleID string, userRoles []string) string {
+    if roleID == "" {
+        return userEmail
+    }
+    return fmt.Sprintf("%s:%s:%s", roleID, userEmail, strings.Join(userRoles, ","))
+}
+
+// fetchBearerToken exchanges a signed JWT for a Skyflow bearer token and returns the token and
+// its expiry. If Skyflow rejects the active key, the previous key is tried during the overlap
+// window after a rotation.
+func fetchBearerToken(ctx context.Context, userEmail string, roleID string) (string, time.Time, error) {
     // Load credentials from Secret Manager
-    creds, err := getCredentials()
+    keys, err := getCredentials()
     if err != nil {
-        return "", err
+        return "", time.Time{}, err
     }
 
+    for i, creds := range keys {
+        token, expiresAt, err := exchangeBearerToken(ctx, creds, userEmail, roleID)
+        var skyflowErr *skyflowError
+        if err != nil && i < len(keys)-1 && errors.As(err, &skyflowErr) &&
+            (skyflowErr.HTTPCode == http.StatusUnauthorized || skyflowErr.HTTPCode == http.StatusForbidden) {
+            log.Printf("[WARN] Skyflow rejected key %s, trying previous key %s", creds.KeyID, keys[i+1].KeyID)
+            continue
+        }
+        return token, expiresAt, err
+    }
+    return "", time.Time{}, errors.New("no Skyflow service account key")
+}
+
+// exchangeBearerToken exchanges a JWT signed with the given key for a Skyflow bearer token
+func exchangeBearerToken(ctx context.Context, creds *SkyflowCredentials, userEmail string, roleID string) (string, time.Time, error) {
     // Generate JWT token
-    signedToken, err := generateJWTToken(creds, userEmail)
+    signedToken, err := generateJWTToken(ctx, creds, userEmail)
     if err != nil {
-        return "", err
+        return "", time.Time{}, err
     }
 
     // Prepare token request
@@ -785,51 +1588,48 @@ func getBearerToken(userEmail string, roleID string, userRoles []string) (string
 
     tokenJSON, err := json.Marshal(tokenData)
     if err != nil {
-        return "", err
+        return "", time.Time{}, err
     }
 
-    // Make request
+    // Make request, retrying transient failures
     log.Printf("[DEBUG] Requesting bearer token from %s", creds.TokenURI)
-    req, err := http.NewRequest("POST", creds.TokenURI, bytes.NewBuffer(tokenJSON))
-    if err != nil {
-        return "", err
-    }
-    req.Header.Set("Content-Type", "application/json")
-
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := getRetryPolicy().doWithRetry(ctx, &http.Client{}, "Token exchange", true, func(ctx context.Context) (*http.Request, error) {
+        req, err := http.NewRequestWithContext(ctx, "POST", creds.TokenURI, bytes.NewBuffer(tokenJSON))
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        return req, nil
+    })
     if err != nil {
-        return "", err
+        return "", time.Time{}, unavailable(fmt.Errorf("error requesting bearer token: %v", err))
     }
     defer resp.Body.Close()
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        return "", err
+        return "", time.Time{}, err
     }
 
     if resp.StatusCode != http.StatusOK {
-        log.Printf("[ERROR] Failed to get bearer token. Status: %d, Response: %s, Request data: %s", 
-            resp.StatusCode, string(body), string(tokenJSON))
-        return "", fmt.Errorf("failed to get bearer token: %s", string(body))
+        skyflowErr := parseSkyflowError("token exchange", resp, body)
+        log.Printf("[ERROR] Failed to get bearer token with scope '%s': HTTP %d, gRPC code %d, request ID %s: %s",
+            tokenData["scope"], skyflowErr.HTTPCode, skyflowErr.GRPCCode, skyflowErr.RequestID, skyflowErr.Message)
+        return "", time.Time{}, &requestError{status: skyflowErr.bigQueryStatus(), err: skyflowErr}
     }
 
     var response map[string]interface{}
     if err := json.Unmarshal(body, &response); err != nil {
-        return "", err
+        return "", time.Time{}, err
     }
 
     accessToken, ok := response["accessToken"].(string)
     if !ok || accessToken == "" {
-        return "", fmt.Errorf("no accessToken in response")
+        return "", time.Time{}, fmt.Errorf("no accessToken in response")
     }
 
-    // Cache token
-    log.Printf("[DEBUG] Successfully got bearer token with scope '%s', caching with key: %s", 
-        tokenData["scope"], key)
-    bearerTokenCache.Store(key, accessToken)
-
-    return accessToken, nil
+    expiresIn, _ := response["expiresIn"].(float64)
+    return accessToken, bearerTokenExpiry(accessToken, expiresIn), nil
 }
 
 // secretManager provides access to Google Cloud Secret Manager
@@ -866,6 +1666,13 @@ func newSecretManager() (*secretManager, error) {
 
 // getSecretData gets a secret's data from Secret Manager
 func (sm *secretManager) getSecretData(ctx context.Context, secretName string) ([]byte, error) {
+    data, _, err := sm.getSecretVersion(ctx, secretName)
+    return data, err
+}
+
+// getSecretVersion gets the latest version of a secret and its resource name, which changes
+// whenever a new version is added
+func (sm *secretManager) getSecretVersion(ctx context.Context, secretName string) ([]byte, string, error) {
     name := fmt.Sprintf("projects/%s/secrets/%s_%s/versions/latest",
         sm.projectID, sm.prefix, secretName)
     
@@ -873,10 +1680,10 @@ func (sm *secretManager) getSecretData(ctx context.Context, secretName string) (
         Name: name,
     })
     if err != nil {
-        return nil, fmt.Errorf("failed to access secret version: %v", err)
+        return nil, "", fmt.Errorf("failed to access secret version: %v", err)
     }
 
-    return result.Payload.Data, nil
+    return result.Payload.Data, result.Name, nil
 }
 
 // Close closes the Secret Manager client
@@ -884,32 +1691,6 @@ func (sm *secretManager) Close() error {
     return sm.client.Close()
 }
 
-// getCredentials loads credentials from Secret Manager
-func getCredentials() (*SkyflowCredentials, error) {
-    if credentials != nil {
-        return credentials, nil
-    }
-
-    sm, err := newSecretManager()
-    if err != nil {
-        return nil, err
-    }
-    defer sm.Close()
-
-    data, err := sm.getSecretData(context.Background(), "credentials")
-    if err != nil {
-        return nil, err
-    }
-
-    var creds SkyflowCredentials
-    if err := json.Unmarshal(data, &creds); err != nil {
-        return nil, fmt.Errorf("failed to unmarshal credentials: %v", err)
-    }
-
-    credentials = &creds
-    return credentials, nil
-}
-
 // getSecret gets a secret from Secret Manager
 func getSecret(secretName string) ([]byte, error) {
     sm, err := newSecretManager()
@@ -922,25 +1703,15 @@ func getSecret(secretName string) ([]byte, error) {
 }
 
 // generateJWTToken generates a JWT token for Skyflow authentication
-func generateJWTToken(creds *SkyflowCredentials, userEmail string) (string, error) {
-    // Decode private key
-    block, _ := pem.Decode([]byte(creds.PrivateKey))
-    if block == nil {
-        return "", errors.New("failed to parse PEM block containing the private key")
-    }
-
-    privKeyInterface, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+func generateJWTToken(ctx context.Context, creds *SkyflowCredentials, userEmail string) (string, error) {
+    signer, err := creds.getSigner(ctx)
     if err != nil {
         return "", err
     }
-    privKey, ok := privKeyInterface.(*rsa.PrivateKey)
-    if !ok {
-        return "", errors.New("not an RSA private key")
-    }
 
     // Create JWT header and claims
     header := map[string]interface{}{
-        "alg": "RS256",
+        "alg": signer.algorithm,
         "typ": "JWT",
     }
 
@@ -972,8 +1743,7 @@ func generateJWTToken(creds *SkyflowCredentials, userEmail string) (string, erro
     unsignedToken := encodedHeader + "." + encodedClaims
 
     // Create signature
-    hash := sha256.Sum256([]byte(unsignedToken))
-    signature, err := rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, hash[:])
+    signature, err := signer.sign(ctx, unsignedToken)
     if err != nil {
         return "", err
     }
@@ -1014,12 +1784,25 @@ func (bq *bigQueryClient) Close() error {
     return bq.client.Close()
 }
 
-// Query executes a query and returns the results
-func (bq *bigQueryClient) Query(ctx context.Context, query string) ([][]interface{}, error) {
+// Read executes a query with optional named parameters and returns an iterator over the results
+func (bq *bigQueryClient) Read(ctx context.Context, query string, params ...bigquery.QueryParameter) (*bigquery.RowIterator, error) {
     q := bq.client.Query(query)
+    q.Parameters = params
     it, err := q.Read(ctx)
     if err != nil {
-        return nil, fmt.Errorf("error executing query: %v", err)
+        return nil, fmt.Errorf("error executing query: %w", err)
+    }
+    return it, nil
+}
+
+// Query executes a query with optional named parameters and returns the results. All rows are
+// held in memory, so use Read for queries over user tables.
+func (bq *bigQueryClient) Query(ctx context.Context, query string, params ...bigquery.QueryParameter) ([][]interface{}, error) {
+    q := bq.client.Query(query)
+    q.Parameters = params
+    it, err := q.Read(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("error executing query: %w", err)
     }
 
     rows := make([][]interface{}, 0)
@@ -1030,7 +1813,7 @@ func (bq *bigQueryClient) Query(ctx context.Context, query string) ([][]interfac
             break
         }
         if err != nil {
-            return nil, fmt.Errorf("error reading row: %v", err)
+            return nil, fmt.Errorf("error reading row: %w", err)
         }
         // Convert BigQuery Values to interface{} slice
         interfaceRow := make([]interface{}, len(row))
@@ -1043,17 +1826,18 @@ func (bq *bigQueryClient) Query(ctx context.Context, query string) ([][]interfac
     return rows, nil
 }
 
-// Update executes an update query
-func (bq *bigQueryClient) Update(ctx context.Context, query string) error {
+// Update executes an update query with optional named parameters
+func (bq *bigQueryClient) Update(ctx context.Context, query string, params ...bigquery.QueryParameter) error {
     q := bq.client.Query(query)
+    q.Parameters = params
     job, err := q.Run(ctx)
     if err != nil {
-        return fmt.Errorf("error executing update: %v", err)
+        return fmt.Errorf("error executing update: %w", err)
     }
 
     status, err := job.Wait(ctx)
     if err != nil {
-        return fmt.Errorf("error waiting for job: %v", err)
+        return fmt.Errorf("error waiting for job: %w", err)
     }
 
     if status.Err() != nil {
@@ -1063,52 +1847,136 @@ func (bq *bigQueryClient) Update(ctx context.Context, query string) error {
     return nil
 }
 
-// queryBigQuery executes a query and returns the results
-func queryBigQuery(query string) ([][]interface{}, error) {
-    bq, err := newBigQueryClient()
-    if err != nil {
-        return nil, err
-    }
-    defer bq.Close()
-
-    return bq.Query(context.Background(), query)
-}
-
-// executeUpdate executes an update query
-func executeUpdate(query string) error {
-    bq, err := newBigQueryClient()
-    if err != nil {
-        return err
-    }
-    defer bq.Close()
-
-    return bq.Update(context.Background(), query)
-}
-
-// batchProcessor is a generic function to process items in batches
-func batchProcessor[T any, R any](items []T, batchSize int, processor func([]T) ([]R, error)) ([]R, error) {
+// concurrentBatchProcessor processes items in batches of batchSize, running up to workers
+// batches at a time and starting each batch once limiter allows it (no limit if nil). Results
+// are returned in input order. The first error cancels the shared context, so batches that have
+// not started yet are skipped.
+func concurrentBatchProcessor[T any, R any](ctx context.Context, items []T, batchSize int, workers int, limiter *rateLimiter, processor func(context.Context, []T) ([]R, error)) ([]R, error) {
     if batchSize <= 0 {
         batchSize = 25 // default batch size
     }
+    if workers <= 0 {
+        workers = 1
+    }
 
-    results := make([]R, 0, len(items))
+    batches := make([][]T, 0, (len(items)+batchSize-1)/batchSize)
     for i := 0; i < len(items); i += batchSize {
         end := i + batchSize
         if end > len(items) {
             end = len(items)
         }
+        batches = append(batches, items[i:end])
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    batchResults := make([][]R, len(batches))
+    var (
+        wg       sync.WaitGroup
+        errOnce  sync.Once
+        firstErr error
+    )
+
+    // Workers take batch indexes until the feed stops
+    indexes := make(chan int)
+    for w := 0; w < workers && w < len(batches); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range indexes {
+                if err := limiter.wait(ctx); err != nil {
+                    continue
+                }
+                results, err := processor(ctx, batches[i])
+                if err != nil {
+                    errOnce.Do(func() {
+                        firstErr = fmt.Errorf("error processing batch: %w", err)
+                        cancel()
+                    })
+                    continue
+                }
+                batchResults[i] = results
+            }
+        }()
+    }
 
-        batch := items[i:end]
-        batchResults, err := processor(batch)
-        if err != nil {
-            return nil, fmt.Errorf("error processing batch: %v", err)
+feed:
+    for i := range batches {
+        select {
+        case indexes <- i:
+        case <-ctx.Done():
+            break feed
         }
-        results = append(results, batchResults...)
     }
+    close(indexes)
+    wg.Wait()
 
+    if firstErr != nil {
+        return nil, firstErr
+    }
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    results := make([]R, 0, len(items))
+    for _, batch := range batchResults {
+        results = append(results, batch...)
+    }
     return results, nil
 }
 
+// rateLimiter spaces out operations so at most a given number start per second
+type rateLimiter struct {
+    sync.Mutex
+    interval time.Duration
+    next     time.Time
+}
+
+// newRateLimiter returns a limiter for perSecond operations per second, or nil (no limit) if
+// perSecond is 0
+func newRateLimiter(perSecond int) *rateLimiter {
+    if perSecond <= 0 {
+        return nil
+    }
+    return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// rateLimiters holds the process-wide rate limiters, keyed by the environment variable setting
+// their rate
+var rateLimiters sync.Map
+
+// sharedRateLimiter returns the rate limiter configured by envVar, created on first use. Every
+// call to an endpoint shares its limiter, so the rate holds across concurrent requests.
+func sharedRateLimiter(envVar string) *rateLimiter {
+    if limiter, ok := rateLimiters.Load(envVar); ok {
+        return limiter.(*rateLimiter)
+    }
+    limiter, _ := rateLimiters.LoadOrStore(envVar, newRateLimiter(getBatchSize(envVar, 0)))
+    return limiter.(*rateLimiter)
+}
+
+// wait blocks until the next operation may start or the context is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+    if l == nil {
+        return ctx.Err()
+    }
+    l.Lock()
+    start := time.Now()
+    if l.next.After(start) {
+        start = l.next
+    }
+    l.next = start.Add(l.interval)
+    l.Unlock()
+
+    timer := time.NewTimer(time.Until(start))
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
 // getBatchSize gets a batch size from environment variable with a default value
 func getBatchSize(envVar string, defaultSize int) int {
     if batchStr := os.Getenv(envVar); batchStr != "" {
@@ -1119,25 +1987,6 @@ func getBatchSize(envVar string, defaultSize int) int {
     return defaultSize
 }
 
-// Helper function to build list of original values for IN clause
-func buildOriginalValuesList(valueTokenMap map[string]string) []string {
-    values := make([]string, 0, len(valueTokenMap))
-    for origValue := range valueTokenMap {
-        values = append(values, fmt.Sprintf("'%s'",
-            strings.ReplaceAll(origValue, "'", "\\'"))) // Escape single quotes
-    }
-    return values
-}
-
-// Helper function to create a map from two slices
-func mapFromSlices(keys, values []string) map[string]string {
-    m := make(map[string]string)
-    for i := range keys {
-        m[keys[i]] = values[i]
-    }
-    return m
-}
-
 // skyflowClient represents a client for making Skyflow API requests
 type skyflowClient struct {
     baseURL     string
@@ -1154,56 +2003,88 @@ func newSkyflowClient() *skyflowClient {
     }
 }
 
-// makeRequest makes a request to the Skyflow API with proper headers and authentication
-func (c *skyflowClient) makeRequest(method, endpoint string, body []byte, bearerToken string) (*http.Response, error) {
-    req, err := http.NewRequest(method, c.baseURL+endpoint, bytes.NewBuffer(body))
-    if err != nil {
-        return nil, fmt.Errorf("error creating request: %v", err)
+// makeRequest makes a request to the Skyflow API with proper headers and authentication.
+// Transient failures are retried according to the retry policy; requests that aren't idempotent
+// only while they can't have been applied. Calls fail immediately while the endpoint's circuit
+// breaker is open.
+func (c *skyflowClient) makeRequest(ctx context.Context, method, endpoint string, body []byte, bearerToken string, idempotent bool) (*http.Response, error) {
+    breaker := getCircuitBreaker(endpoint)
+    if err := breaker.allow(); err != nil {
+        return nil, err
     }
 
-    // Set standard headers
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("Accept", "application/json")
-    req.Header.Set("Authorization", "Bearer "+bearerToken)
-    req.Header.Set("X-SKYFLOW-ACCOUNT-ID", c.accountID)
+    resp, err := getRetryPolicy().doWithRetry(ctx, c.httpClient, "Skyflow "+endpoint, idempotent, func(ctx context.Context) (*http.Request, error) {
+        req, err := http.NewRequestWithContext(ctx, method, c.baseURL+endpoint, bytes.NewBuffer(body))
+        if err != nil {
+            return nil, err
+        }
 
-    return c.httpClient.Do(req)
+        // Set standard headers
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("Accept", "application/json")
+        req.Header.Set("Authorization", "Bearer "+bearerToken)
+        req.Header.Set("X-SKYFLOW-ACCOUNT-ID", c.accountID)
+        return req, nil
+    })
+    switch {
+    case err != nil && ctx.Err() != nil:
+        breaker.release()
+    case err != nil:
+        breaker.record(err)
+    case isBreakerFailure(resp.StatusCode):
+        breaker.record(fmt.Errorf("status %d", resp.StatusCode))
+    default:
+        breaker.record(nil)
+    }
+    return resp, err
 }
 
-// completeTokenPromise completes a token promise and returns a BigQuery response
-func completeTokenPromise(promise *tokenPromise, value string, token string, err error) (*BigQueryResponse, error) {
+// completeTokenPromise completes a token promise and removes it from the in-flight cache
+func completeTokenPromise(promise *tokenPromise, value fieldValue, token string, err error) {
     promise.token = token
     promise.err = err
     close(promise.done)
     inFlightRequests.Delete(value)
-    return &BigQueryResponse{Replies: []interface{}{token}}, err
 }
 
 // makeSkyflowAPIRequest makes a generic request to the Skyflow API
-func makeSkyflowAPIRequest[Req any, Resp any](endpoint string, req Req, userEmail string, roleID string) (*Resp, error) {
+func makeSkyflowAPIRequest[Req any, Resp any](ctx context.Context, endpoint string, req Req, userEmail string, roleID string) (*Resp, error) {
     client := newSkyflowClient()
 
     // Get user roles from context
-    ctx := context.Background()
     roles, err := getUserRoles(ctx, userEmail)
     if err != nil {
-        return nil, fmt.Errorf("error getting user roles: %v", err)
+        return nil, fmt.Errorf("error getting user roles: %w", orUnavailable(err))
     }
 
     // Get bearer token with user context and role ID
-    bearerToken, err := getBearerToken(userEmail, roleID, roles)
+    bearerToken, err := getBearerToken(ctx, userEmail, roleID, roles)
     if err != nil {
-        return nil, fmt.Errorf("error getting bearer token: %v", err)
+        return nil, fmt.Errorf("error getting bearer token: %w", err)
     }
 
     jsonData, err := json.Marshal(req)
     if err != nil {
         return nil, fmt.Errorf("error marshaling request: %v", err)
     }
+    idempotent := true
+    if r, ok := any(req).(idempotentRequest); ok {
+        idempotent = r.idempotent()
+    }
 
-    resp, err := client.makeRequest("POST", endpoint, jsonData, bearerToken)
+    resp, err := client.makeRequest(ctx, "POST", endpoint, jsonData, bearerToken, idempotent)
+    if err == nil && resp.StatusCode == http.StatusUnauthorized {
+        // The cached token expired or was revoked early, so fetch a new one and try once more
+        resp.Body.Close()
+        log.Printf("[WARN] Skyflow %s rejected the bearer token, fetching a new one", endpoint)
+        getBearerTokenCache().evict(bearerTokenKey(userEmail, roleID, roles), bearerToken)
+        if bearerToken, err = getBearerToken(ctx, userEmail, roleID, roles); err != nil {
+            return nil, fmt.Errorf("error getting bearer token: %w", err)
+        }
+        resp, err = client.makeRequest(ctx, "POST", endpoint, jsonData, bearerToken, idempotent)
+    }
     if err != nil {
-        return nil, fmt.Errorf("error making request: %v", err)
+        return nil, unavailable(fmt.Errorf("error making request: %v", err))
     }
     defer resp.Body.Close()
 
@@ -1212,8 +2093,11 @@ func makeSkyflowAPIRequest[Req any, Resp any](endpoint string, req Req, userEmai
         return nil, fmt.Errorf("error reading response: %v", err)
     }
 
-    if resp.StatusCode != http.StatusOK {
-        return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+    if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultiStatus {
+        skyflowErr := parseSkyflowError(endpoint, resp, body)
+        log.Printf("[ERROR] Skyflow %s failed with HTTP %d, gRPC code %d, request ID %s: %s",
+            endpoint, skyflowErr.HTTPCode, skyflowErr.GRPCCode, skyflowErr.RequestID, skyflowErr.Message)
+        return nil, &requestError{status: skyflowErr.bigQueryStatus(), err: skyflowErr}
     }
 
     var skyflowResp Resp
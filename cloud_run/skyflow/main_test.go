@@ -0,0 +1,152 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestConcurrentBatchProcessor(t *testing.T) {
+    items := make([]int, 103)
+    for i := range items {
+        items[i] = i
+    }
+
+    tests := []struct {
+        name      string
+        batchSize int
+        workers   int
+        failAt    int // First item of the batch that fails, -1 for none
+    }{
+        {name: "one worker", batchSize: 10, workers: 1, failAt: -1},
+        {name: "more workers than batches", batchSize: 50, workers: 8, failAt: -1},
+        {name: "uneven last batch", batchSize: 7, workers: 4, failAt: -1},
+        {name: "default batch size", batchSize: 0, workers: 0, failAt: -1},
+        {name: "first batch fails", batchSize: 1, workers: 2, failAt: 0},
+        {name: "middle batch fails", batchSize: 10, workers: 4, failAt: 50},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var calls int32
+            errBatch := errors.New("batch failed")
+            got, err := concurrentBatchProcessor(context.Background(), items, tt.batchSize, tt.workers, nil,
+                func(ctx context.Context, batch []int) ([]int, error) {
+                    atomic.AddInt32(&calls, 1)
+                    // Finish batches out of order
+                    time.Sleep(time.Duration(len(items)-batch[0]) * 10 * time.Microsecond)
+                    if tt.failAt >= 0 && batch[0] <= tt.failAt && tt.failAt < batch[0]+len(batch) {
+                        return nil, errBatch
+                    }
+                    out := make([]int, len(batch))
+                    copy(out, batch)
+                    return out, nil
+                })
+
+            if tt.failAt >= 0 {
+                if !errors.Is(err, errBatch) {
+                    t.Fatalf("error = %v, want %v", err, errBatch)
+                }
+                if got != nil {
+                    t.Errorf("results = %v, want nil on error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("error: %v", err)
+            }
+            if len(got) != len(items) {
+                t.Fatalf("got %d results, want %d", len(got), len(items))
+            }
+            for i, v := range got {
+                if v != i {
+                    t.Fatalf("result %d = %d, want results in input order", i, v)
+                }
+            }
+        })
+    }
+}
+
+func TestConcurrentBatchProcessorStopsAfterError(t *testing.T) {
+    items := make([]int, 100)
+    var calls int32
+    _, err := concurrentBatchProcessor(context.Background(), items, 1, 2, newRateLimiter(100),
+        func(ctx context.Context, batch []int) ([]int, error) {
+            atomic.AddInt32(&calls, 1)
+            return nil, errors.New("boom")
+        })
+    if err == nil {
+        t.Fatal("expected an error")
+    }
+    if n := atomic.LoadInt32(&calls); n > 3 {
+        t.Errorf("%d batches ran after the first error, want the rest skipped", n)
+    }
+}
+
+func TestConcurrentBatchProcessorCanceled(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err := concurrentBatchProcessor(ctx, []int{1, 2, 3}, 1, 1, nil,
+        func(ctx context.Context, batch []int) ([]int, error) {
+            return batch, nil
+        })
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("error = %v, want %v", err, context.Canceled)
+    }
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+    t.Setenv("TEST_RATE_LIMIT", "20")
+    limiter := sharedRateLimiter("TEST_RATE_LIMIT")
+    if limiter == nil {
+        t.Fatal("no limiter for a rate of 20")
+    }
+    if again := sharedRateLimiter("TEST_RATE_LIMIT"); again != limiter {
+        t.Error("calls got different limiters, want one shared limiter")
+    }
+    if unlimited := sharedRateLimiter("TEST_RATE_LIMIT_UNSET"); unlimited != nil {
+        t.Error("got a limiter for an unset rate, want none")
+    }
+
+    // Two callers share the rate: 5 operations at 20 per second take at least 200ms
+    start := time.Now()
+    done := make(chan struct{})
+    for c := 0; c < 2; c++ {
+        go func(n int) {
+            for i := 0; i < n; i++ {
+                limiter.wait(context.Background())
+            }
+            done <- struct{}{}
+        }(2 + c)
+    }
+    <-done
+    <-done
+    if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+        t.Errorf("5 operations took %v, want the shared rate to space them out", elapsed)
+    }
+}
+
+func TestTokenizeValuesStopsWaitingWhenCanceled(t *testing.T) {
+    // Another request owns the value and never completes it
+    value := fieldValue{Field: skyflowField{Table: "persons", Field: "email"}, Value: "stalled@example.com"}
+    inFlightRequests.Store(value, &tokenPromise{done: make(chan struct{})})
+    defer inFlightRequests.Delete(value)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    done := make(chan map[fieldValue]error, 1)
+    go func() {
+        _, errs := tokenizeValues(ctx, []fieldValue{value}, testCaller)
+        done <- errs
+    }()
+
+    select {
+    case errs := <-done:
+        if !errors.Is(errs[value], context.DeadlineExceeded) {
+            t.Errorf("error = %v, want %v", errs[value], context.DeadlineExceeded)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("tokenizeValues kept waiting for another request's value after its context ended")
+    }
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "fmt"
+    "strings"
+)
+
+// pathSegment is one field of a column path
+type pathSegment struct {
+    Name     string
+    Repeated bool // Every element of an ARRAY field, written name[]
+}
+
+// columnPath addresses a STRING column or a STRING leaf nested in STRUCT and ARRAY columns, such
+// as contact.email or addresses[].line1
+type columnPath []pathSegment
+
+// parseColumnPath parses a dotted column path. Each field is a plain or backtick-quoted name,
+// optionally followed by [] to address every element of an ARRAY.
+func parseColumnPath(path string) (columnPath, error) {
+    path = strings.TrimSpace(path)
+    segments := make(columnPath, 0, 1)
+    for rest := path; ; {
+        var field string
+        if strings.HasPrefix(rest, "`") {
+            end := strings.IndexByte(rest[1:], '`')
+            if end < 0 {
+                return nil, badRequest("invalid column path %q", path)
+            }
+            field, rest = rest[:end+2], rest[end+2:]
+        } else {
+            end := strings.IndexAny(rest, ".[")
+            if end < 0 {
+                end = len(rest)
+            }
+            field, rest = rest[:end], rest[end:]
+        }
+
+        name, err := parseColumnName(field)
+        if err != nil {
+            return nil, badRequest("invalid column path %q", path)
+        }
+        segment := pathSegment{Name: name}
+        if strings.HasPrefix(rest, "[]") {
+            segment.Repeated = true
+            rest = rest[2:]
+        }
+        segments = append(segments, segment)
+
+        if rest == "" {
+            return segments, nil
+        }
+        if !strings.HasPrefix(rest, ".") {
+            return nil, badRequest("invalid column path %q", path)
+        }
+        rest = rest[1:]
+    }
+}
+
+// String returns the path in the form parseColumnPath accepts
+func (p columnPath) String() string {
+    fields := make([]string, len(p))
+    for i, segment := range p {
+        fields[i] = segment.Name
+        if !plainColumnPattern.MatchString(segment.Name) {
+            fields[i] = quoteIdentifier(segment.Name)
+        }
+        if segment.Repeated {
+            fields[i] += "[]"
+        }
+    }
+    return strings.Join(fields, ".")
+}
+
+// isColumn reports whether the path is a plain top-level column
+func (p columnPath) isColumn() bool {
+    return len(p) == 1 && !p[0].Repeated
+}
+
+// isArrayElement reports whether the path's leaf values are elements of an ARRAY, which can't
+// be NULL
+func (p columnPath) isArrayElement() bool {
+    return p[len(p)-1].Repeated
+}
+
+// column returns the quoted top-level column of the path
+func (p columnPath) column() string {
+    return quoteIdentifier(p[0].Name)
+}
+
+// resolve checks the path against a table schema. Every field but the last must be a STRUCT,
+// ARRAY fields must be marked with [], and the leaf must be a STRING. Returns the path with names
+// as spelled in the schema.
+func (p columnPath) resolve(schema bigquery.Schema, table tableRef) (columnPath, error) {
+    resolved := make(columnPath, len(p))
+    for i, segment := range p {
+        field := findField(schema, segment.Name)
+        if field == nil {
+            return nil, badRequest("column %q does not exist in table %s", p[:i+1], table)
+        }
+        if field.Repeated != segment.Repeated {
+            if field.Repeated {
+                return nil, badRequest("column %q in table %s is an ARRAY, use %s[]", p[:i+1], table, segment.Name)
+            }
+            return nil, badRequest("column %q in table %s is not an ARRAY", p[:i+1], table)
+        }
+        resolved[i] = pathSegment{Name: field.Name, Repeated: field.Repeated}
+
+        if i < len(p)-1 {
+            if field.Type != bigquery.RecordFieldType {
+                return nil, badRequest("column %q in table %s has type %s, expected STRUCT", p[:i+1], table, fieldTypeName(field))
+            }
+            schema = field.Schema
+        } else if field.Type != bigquery.StringFieldType {
+            return nil, badRequest("column %q in table %s has type %s, expected STRING", p, table, fieldTypeName(field))
+        }
+    }
+    return resolved, nil
+}
+
+// leaves returns the UNNEST clauses that flatten the path's arrays for one row of root, and the
+// expression of a leaf value over them. root is a table alias, or empty for unqualified columns.
+func (p columnPath) leaves(root string) ([]string, string) {
+    unnests := make([]string, 0)
+    expr := root
+    for i, segment := range p {
+        if expr == "" {
+            expr = quoteIdentifier(segment.Name)
+        } else {
+            expr += "." + quoteIdentifier(segment.Name)
+        }
+        if segment.Repeated {
+            alias := fmt.Sprintf("_skyflow_e%d", i)
+            unnests = append(unnests, fmt.Sprintf("UNNEST(%s) AS %s", expr, alias))
+            expr = alias
+        }
+    }
+    return unnests, expr
+}
+
+// containsAny returns a condition that holds for rows with a leaf value in the given set query
+func (p columnPath) containsAny(set string) string {
+    unnests, leaf := p.leaves("")
+    if len(unnests) == 0 {
+        return fmt.Sprintf("%s IN (%s)", leaf, set)
+    }
+    return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s IN (%s))", strings.Join(unnests, ", "), leaf, set)
+}
+
+// rewrite returns an expression for the path's top-level column with every leaf value replaced
+// by replace(leaf). Other fields, array order and NULL structs are kept as they are. Every array
+// element is kept; arrays can't hold NULL, so replacing an element with NULL fails the query
+// rather than shortening the array.
+func (p columnPath) rewrite(replace func(leaf string) string) string {
+    return rewriteField("", p, 0, replace)
+}
+
+// rewriteField returns the new value of the path's field at depth within parent
+func rewriteField(parent string, p columnPath, depth int, replace func(string) string) string {
+    segment := p[depth]
+    field := quoteIdentifier(segment.Name)
+    if parent != "" {
+        field = parent + "." + field
+    }
+    if !segment.Repeated {
+        return rewriteValue(field, p, depth+1, replace)
+    }
+
+    element := fmt.Sprintf("_skyflow_e%d", depth)
+    offset := fmt.Sprintf("_skyflow_o%d", depth)
+    return fmt.Sprintf("ARRAY(SELECT %s FROM UNNEST(%s) AS %s WITH OFFSET AS %s ORDER BY %s)",
+        rewriteValue(element, p, depth+1, replace), field, element, offset, offset)
+}
+
+// rewriteValue returns the new value of expr, the value at depth of the path
+func rewriteValue(expr string, p columnPath, depth int, replace func(string) string) string {
+    if depth == len(p) {
+        return replace(expr)
+    }
+    return fmt.Sprintf("IF(%s IS NULL, NULL, (SELECT AS STRUCT %s.* REPLACE (%s AS %s)))",
+        expr, expr, rewriteField(expr, p, depth, replace), quoteIdentifier(p[depth].Name))
+}
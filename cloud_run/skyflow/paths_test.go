@@ -0,0 +1,90 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestParseColumnPath(t *testing.T) {
+    tests := []struct {
+        path        string
+        want        string
+        wantColumn  bool
+        wantElement bool
+        wantErr     bool
+    }{
+        {path: "email", want: "email", wantColumn: true},
+        {path: " `first name` ", want: "`first name`", wantColumn: true},
+        {path: "contact.email", want: "contact.email"},
+        {path: "addresses[].line1", want: "addresses[].line1"},
+        {path: "phones[]", want: "phones[]", wantElement: true},
+        {path: "`a b`.c[].d", want: "`a b`.c[].d"},
+        {path: "a.b[].c[]", want: "a.b[].c[]", wantElement: true},
+        {path: "a..b", wantErr: true},
+        {path: "a[", wantErr: true},
+        {path: "a[].", wantErr: true},
+        {path: ".a", wantErr: true},
+        {path: "a[]b", wantErr: true},
+        {path: "a.`b", wantErr: true},
+        {path: "a[0]", wantErr: true},
+        {path: "a;b", wantErr: true},
+        {path: "", wantErr: true},
+    }
+    for _, tt := range tests {
+        got, err := parseColumnPath(tt.path)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("parseColumnPath(%q) = %v, want error", tt.path, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parseColumnPath(%q) error: %v", tt.path, err)
+            continue
+        }
+        if got.String() != tt.want {
+            t.Errorf("parseColumnPath(%q) = %s, want %s", tt.path, got, tt.want)
+        }
+        if got.isColumn() != tt.wantColumn {
+            t.Errorf("parseColumnPath(%q).isColumn() = %t, want %t", tt.path, got.isColumn(), tt.wantColumn)
+        }
+        if got.isArrayElement() != tt.wantElement {
+            t.Errorf("parseColumnPath(%q).isArrayElement() = %t, want %t", tt.path, got.isArrayElement(), tt.wantElement)
+        }
+    }
+}
+
+func TestColumnPathRewrite(t *testing.T) {
+    replace := func(leaf string) string { return "F(" + leaf + ")" }
+    tests := []struct {
+        path string
+        want string
+    }{
+        {
+            path: "phones[]",
+            want: "ARRAY(SELECT F(_skyflow_e0) FROM UNNEST(`phones`) AS _skyflow_e0 WITH OFFSET AS _skyflow_o0 ORDER BY _skyflow_o0)",
+        },
+        {
+            path: "contact.email",
+            want: "IF(`contact` IS NULL, NULL, (SELECT AS STRUCT `contact`.* REPLACE (F(`contact`.`email`) AS `email`)))",
+        },
+        {
+            path: "addresses[].line1",
+            want: "ARRAY(SELECT IF(_skyflow_e0 IS NULL, NULL, (SELECT AS STRUCT _skyflow_e0.* REPLACE (F(_skyflow_e0.`line1`) AS `line1`))) " +
+                "FROM UNNEST(`addresses`) AS _skyflow_e0 WITH OFFSET AS _skyflow_o0 ORDER BY _skyflow_o0)",
+        },
+    }
+    for _, tt := range tests {
+        path, err := parseColumnPath(tt.path)
+        if err != nil {
+            t.Fatalf("parseColumnPath(%q) error: %v", tt.path, err)
+        }
+        got := path.rewrite(replace)
+        if got != tt.want {
+            t.Errorf("%s rewrite = %s, want %s", tt.path, got, tt.want)
+        }
+        if strings.Contains(got, "IS NOT NULL") {
+            t.Errorf("%s rewrite drops NULL elements: %s", tt.path, got)
+        }
+    }
+}
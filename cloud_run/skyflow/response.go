@@ -0,0 +1,228 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "google.golang.org/api/googleapi"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+)
+
+// requestError is an error carrying the HTTP status code reported back to BigQuery.
+// BigQuery retries remote function calls that fail with 408, 429, 500, 503 or 504 and
+// fails the query with the returned errorMessage for any other status.
+type requestError struct {
+    status int
+    err    error
+}
+
+func (e *requestError) Error() string {
+    return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+    return e.err
+}
+
+// badRequest returns a non-retryable error for invalid input
+func badRequest(format string, args ...interface{}) error {
+    return &requestError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+// unavailable returns a retryable error for transient failures of a dependency
+func unavailable(err error) error {
+    return &requestError{status: http.StatusServiceUnavailable, err: err}
+}
+
+// orUnavailable returns err as a retryable error unless it already carries a status, e.g. an IAM
+// misconfiguration that retrying won't fix
+func orUnavailable(err error) error {
+    var reqErr *requestError
+    if errors.As(err, &reqErr) {
+        return err
+    }
+    return unavailable(err)
+}
+
+// Reasons of BigQuery job errors that are transient
+var transientBigQueryReasons = map[string]bool{
+    "backendError":      true,
+    "internalError":     true,
+    "rateLimitExceeded": true,
+}
+
+// errorStatus returns the HTTP status code BigQuery should receive for an error. Only failures
+// known to be transient are retryable: Skyflow and Google API errors of a retryable status, open
+// circuits and expired or cancelled requests. Any other error, e.g. Skyflow returning fewer
+// records than were inserted, fails the query, since a retry could repeat a request that was
+// already applied.
+func errorStatus(err error) int {
+    var reqErr *requestError
+    if errors.As(err, &reqErr) {
+        return reqErr.status
+    }
+    var skyflowErr *skyflowError
+    if errors.As(err, &skyflowErr) {
+        return skyflowErr.bigQueryStatus()
+    }
+    var circuitErr *circuitOpenError
+    if errors.As(err, &circuitErr) {
+        return http.StatusServiceUnavailable
+    }
+    if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+        return http.StatusServiceUnavailable
+    }
+    var apiErr *googleapi.Error
+    if errors.As(err, &apiErr) {
+        switch {
+        case apiErr.Code == http.StatusTooManyRequests:
+            return http.StatusTooManyRequests
+        case apiErr.Code == http.StatusRequestTimeout, apiErr.Code >= 500:
+            return http.StatusServiceUnavailable
+        }
+        return http.StatusBadRequest
+    }
+    var bqErr *bigquery.Error
+    if errors.As(err, &bqErr) && transientBigQueryReasons[bqErr.Reason] {
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusBadRequest
+}
+
+// isRetryableStatus reports whether BigQuery retries a remote function call failing with status
+func isRetryableStatus(status int) bool {
+    switch status {
+    case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+        http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true
+    }
+    return false
+}
+
+// BigQueryErrorResponse represents an error response to BigQuery
+type BigQueryErrorResponse struct {
+    ErrorMessage string `json:"errorMessage"`
+}
+
+// writeResponse writes a successful BigQuery response
+func writeResponse(w http.ResponseWriter, response interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("[ERROR] Failed to encode response: %v", err)
+    }
+}
+
+// writeError writes an error response using BigQuery's errorMessage contract
+func writeError(w http.ResponseWriter, err error) {
+    status := errorStatus(err)
+    log.Printf("[ERROR] Request failed with status %d (retryable: %t): %v", status, isRetryableStatus(status), err)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    if encodeErr := json.NewEncoder(w).Encode(BigQueryErrorResponse{ErrorMessage: err.Error()}); encodeErr != nil {
+        log.Printf("[ERROR] Failed to encode error response: %v", encodeErr)
+    }
+}
+
+// rowError records the failure of a single call in a BigQuery request
+type rowError struct {
+    Call      int    `json:"call"`
+    Error     string `json:"error"`
+    Status    int    `json:"status"`
+    Retryable bool   `json:"retryable"`
+
+    err error
+}
+
+// responseBuilder collects per-call replies and errors for a BigQuery remote function response
+type responseBuilder struct {
+    requestID    string
+    operation    string
+    allowPartial bool
+    replies      []interface{}
+    rowErrors    []rowError
+}
+
+// newResponseBuilder creates a response builder with one NULL reply per call in the request
+func newResponseBuilder(req BigQueryRequest) *responseBuilder {
+    userContext, _ := req.userContext()
+    return &responseBuilder{
+        requestID:    req.RequestID,
+        operation:    userContext.Operation,
+        allowPartial: userContext.allowPartialResults(),
+        replies:      make([]interface{}, len(req.Calls)),
+    }
+}
+
+// setReply sets the reply for a call
+func (b *responseBuilder) setReply(call int, reply interface{}) {
+    b.replies[call] = reply
+}
+
+// setError records a failure for a call. The call's reply is NULL if partial results are allowed.
+func (b *responseBuilder) setError(call int, err error) {
+    status := errorStatus(err)
+    b.replies[call] = nil
+    b.rowErrors = append(b.rowErrors, rowError{
+        Call:      call,
+        Error:     err.Error(),
+        Status:    status,
+        Retryable: isRetryableStatus(status),
+        err:       err,
+    })
+}
+
+// build returns the BigQuery response. Retryable failures always fail the request so BigQuery
+// retries it. Other failures fail the request unless the caller allows partial results, in which
+// case the failed calls reply NULL and the failures are written to the error report log.
+func (b *responseBuilder) build() (*BigQueryResponse, error) {
+    if len(b.rowErrors) == 0 {
+        return &BigQueryResponse{Replies: b.replies}, nil
+    }
+
+    var firstRetryable, firstPermanent *rowError
+    for i := range b.rowErrors {
+        rowErr := &b.rowErrors[i]
+        if rowErr.Retryable && firstRetryable == nil {
+            firstRetryable = rowErr
+        }
+        if !rowErr.Retryable && firstPermanent == nil {
+            firstPermanent = rowErr
+        }
+    }
+
+    if firstPermanent != nil && !b.allowPartial {
+        return nil, fmt.Errorf("call %d: %w", firstPermanent.Call, firstPermanent.err)
+    }
+    if firstRetryable != nil {
+        return nil, fmt.Errorf("call %d: %w", firstRetryable.Call, firstRetryable.err)
+    }
+
+    b.reportErrors()
+    return &BigQueryResponse{Replies: b.replies}, nil
+}
+
+// reportErrors writes the per-call failures of a partial response to the log, keyed by the
+// BigQuery request ID so they can be correlated with the query that issued the calls
+func (b *responseBuilder) reportErrors() {
+    report, err := json.Marshal(struct {
+        RequestID string     `json:"requestId"`
+        Operation string     `json:"operation"`
+        Calls     int        `json:"calls"`
+        Errors    []rowError `json:"errors"`
+    }{
+        RequestID: b.requestID,
+        Operation: b.operation,
+        Calls:     len(b.replies),
+        Errors:    b.rowErrors,
+    })
+    if err != nil {
+        log.Printf("[ERROR] Failed to encode error report for request %s: %v", b.requestID, err)
+        return
+    }
+    log.Printf("[WARN] Returning partial results for request %s with %d failed calls: %s",
+        b.requestID, len(b.rowErrors), string(report))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "google.golang.org/api/googleapi"
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+    tests := []struct {
+        name          string
+        err           error
+        want          int
+        wantRetryable bool
+    }{
+        {name: "bad request", err: badRequest("invalid column"), want: http.StatusBadRequest},
+        {name: "unavailable", err: unavailable(errors.New("down")), want: http.StatusServiceUnavailable, wantRetryable: true},
+        {name: "wrapped request error", err: fmt.Errorf("call 0: %w", &requestError{status: http.StatusTooManyRequests, err: errors.New("busy")}), want: http.StatusTooManyRequests, wantRetryable: true},
+        {name: "Skyflow rate limit", err: fmt.Errorf("x: %w", &skyflowError{HTTPCode: http.StatusTooManyRequests}), want: http.StatusTooManyRequests, wantRetryable: true},
+        {name: "Skyflow server error", err: &skyflowError{HTTPCode: http.StatusBadGateway}, want: http.StatusServiceUnavailable, wantRetryable: true},
+        {name: "Skyflow not found", err: &skyflowError{HTTPCode: http.StatusNotFound}, want: http.StatusBadRequest},
+        {name: "circuit open", err: fmt.Errorf("x: %w", &circuitOpenError{endpoint: "insert"}), want: http.StatusServiceUnavailable, wantRetryable: true},
+        {name: "deadline", err: fmt.Errorf("x: %w", context.DeadlineExceeded), want: http.StatusServiceUnavailable, wantRetryable: true},
+        {name: "Google API server error", err: fmt.Errorf("x: %w", &googleapi.Error{Code: http.StatusInternalServerError}), want: http.StatusServiceUnavailable, wantRetryable: true},
+        {name: "Google API rate limit", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: http.StatusTooManyRequests, wantRetryable: true},
+        {name: "Google API not found", err: &googleapi.Error{Code: http.StatusNotFound}, want: http.StatusBadRequest},
+        {name: "BigQuery backend error", err: fmt.Errorf("x: %w", &bigquery.Error{Reason: "backendError"}), want: http.StatusServiceUnavailable, wantRetryable: true},
+        {name: "BigQuery invalid query", err: &bigquery.Error{Reason: "invalidQuery"}, want: http.StatusBadRequest},
+        {name: "record count mismatch", err: fmt.Errorf("Skyflow returned %d records for %d inserted", 1, 2), want: http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        got := errorStatus(tt.err)
+        if got != tt.want {
+            t.Errorf("%s: errorStatus = %d, want %d", tt.name, got, tt.want)
+        }
+        if isRetryableStatus(got) != tt.wantRetryable {
+            t.Errorf("%s: retryable = %t, want %t", tt.name, isRetryableStatus(got), tt.wantRetryable)
+        }
+    }
+}
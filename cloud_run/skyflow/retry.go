@@ -0,0 +1,177 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/http/httptrace"
+    "strconv"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// retryPolicy controls how failed calls to Skyflow and its token endpoint are retried
+type retryPolicy struct {
+    MaxAttempts int           // Attempts per call, including the first
+    BaseDelay   time.Duration // Backoff before the first retry, doubled for every further retry
+    MaxDelay    time.Duration // Upper bound of a single backoff
+    MaxElapsed  time.Duration // Upper bound of the time spent on a call, including backoff
+}
+
+// getRetryPolicy returns the retry policy configured with SKYFLOW_RETRY_* variables
+func getRetryPolicy() retryPolicy {
+    return retryPolicy{
+        MaxAttempts: getBatchSize("SKYFLOW_RETRY_MAX_ATTEMPTS", 4),
+        BaseDelay:   time.Duration(getBatchSize("SKYFLOW_RETRY_BASE_DELAY_MS", 200)) * time.Millisecond,
+        MaxDelay:    time.Duration(getBatchSize("SKYFLOW_RETRY_MAX_DELAY_MS", 5000)) * time.Millisecond,
+        MaxElapsed:  time.Duration(getBatchSize("SKYFLOW_RETRY_MAX_ELAPSED_MS", 30000)) * time.Millisecond,
+    }
+}
+
+// doWithRetry sends the request built by newRequest, retrying connection failures and retryable
+// statuses with exponential backoff and full jitter. A Retry-After header sets the minimum wait.
+// A request that isn't idempotent is only retried if it failed before it was sent or the server
+// rejected it without processing it (408 or 429), so it is never applied twice. Retries stop
+// after MaxAttempts, or when the next attempt could not start before MaxElapsed or the context's
+// deadline; the last response or error is then returned. name identifies the call in logs.
+func (p retryPolicy) doWithRetry(ctx context.Context, client *http.Client, name string, idempotent bool, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+    start := time.Now()
+    deadline := start.Add(p.MaxElapsed)
+    if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+        deadline = ctxDeadline
+    }
+
+    for attempt := 1; ; attempt++ {
+        req, err := newRequest(ctx)
+        if err != nil {
+            return nil, fmt.Errorf("error creating request: %v", err)
+        }
+
+        // Record whether the request was written, after which the server may have applied it
+        var sent atomic.Bool
+        req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+            WroteRequest: func(info httptrace.WroteRequestInfo) {
+                if info.Err == nil {
+                    sent.Store(true)
+                }
+            },
+        }))
+
+        resp, err := client.Do(req)
+        retryAfter := time.Duration(0)
+        switch {
+        case err != nil:
+            if !isRetryableError(ctx, err) {
+                return nil, err
+            }
+            if !idempotent && sent.Load() {
+                log.Printf("[WARN] %s failed after the request was sent, not retrying since it may have been applied: %v", name, err)
+                return nil, err
+            }
+        case isRetryableResponse(resp.StatusCode):
+            if !idempotent && !isRejectedResponse(resp.StatusCode) {
+                log.Printf("[WARN] %s returned status %d, not retrying since the request may have been applied", name, resp.StatusCode)
+                return resp, nil
+            }
+            retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+        default:
+            return resp, nil
+        }
+
+        if attempt >= p.MaxAttempts {
+            log.Printf("[WARN] %s failed after %d attempts", name, attempt)
+            return resp, err
+        }
+        delay := p.backoff(attempt)
+        if retryAfter > delay {
+            delay = retryAfter
+        }
+        if time.Now().Add(delay).After(deadline) {
+            log.Printf("[WARN] %s failed after %d attempts, no time left to retry", name, attempt)
+            return resp, err
+        }
+
+        if err != nil {
+            log.Printf("[WARN] %s attempt %d failed, retrying in %v: %v", name, attempt, delay, err)
+        } else {
+            log.Printf("[WARN] %s attempt %d returned status %d, retrying in %v", name, attempt, resp.StatusCode, delay)
+            // Drain the body so the connection can be reused
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }
+
+        timer := time.NewTimer(delay)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// backoff returns a random delay before retry number attempt, up to an exponentially growing cap
+func (p retryPolicy) backoff(attempt int) time.Duration {
+    ceiling := p.BaseDelay << (attempt - 1)
+    if ceiling > p.MaxDelay || ceiling <= 0 {
+        ceiling = p.MaxDelay
+    }
+    if ceiling <= 0 {
+        return 0
+    }
+    return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// isRetryableResponse reports whether a response status is worth retrying: rate limiting and
+// transient server errors
+func isRetryableResponse(status int) bool {
+    switch status {
+    case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+        http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true
+    }
+    return false
+}
+
+// isRejectedResponse reports whether a retryable status means the server rejected the request
+// without processing it, so a request that isn't idempotent may be sent again
+func isRejectedResponse(status int) bool {
+    return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// isRetryableError reports whether a failed request is worth retrying: timeouts, resets and
+// refused or dropped connections. Errors after the context is done are not retried.
+func isRetryableError(ctx context.Context, err error) bool {
+    if ctx.Err() != nil {
+        return false
+    }
+    if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+        errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return true
+    }
+    var netErr net.Error
+    return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date. Returns 0 if
+// the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+    if value == "" {
+        return 0
+    }
+    if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+        return time.Duration(seconds) * time.Second
+    }
+    if date, err := http.ParseTime(value); err == nil {
+        if delay := time.Until(date); delay > 0 {
+            return delay
+        }
+    }
+    return 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestDoWithRetry(t *testing.T) {
+    policy := retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, MaxElapsed: 5 * time.Second}
+
+    tests := []struct {
+        name         string
+        idempotent   bool
+        statuses     []int // Status of each attempt; the last one repeats
+        hangUp       bool  // Close the connection without a response instead
+        wantAttempts int32
+        wantStatus   int // 0 if an error is expected
+    }{
+        {name: "success", idempotent: true, statuses: []int{200}, wantAttempts: 1, wantStatus: 200},
+        {name: "retries 503", idempotent: true, statuses: []int{503, 503, 200}, wantAttempts: 3, wantStatus: 200},
+        {name: "gives up after max attempts", idempotent: true, statuses: []int{500}, wantAttempts: 3, wantStatus: 500},
+        {name: "no retry of 400", idempotent: true, statuses: []int{400}, wantAttempts: 1, wantStatus: 400},
+        {name: "retries dropped connection", idempotent: true, hangUp: true, wantAttempts: 3},
+        {name: "insert retries 429", statuses: []int{429, 200}, wantAttempts: 2, wantStatus: 200},
+        {name: "insert retries 408", statuses: []int{408, 200}, wantAttempts: 2, wantStatus: 200},
+        {name: "insert not retried on 503", statuses: []int{503, 200}, wantAttempts: 1, wantStatus: 503},
+        {name: "insert not retried on 500", statuses: []int{500, 200}, wantAttempts: 1, wantStatus: 500},
+        {name: "insert not retried once sent", hangUp: true, wantAttempts: 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var attempts int32
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                n := atomic.AddInt32(&attempts, 1)
+                if tt.hangUp {
+                    conn, _, err := w.(http.Hijacker).Hijack()
+                    if err == nil {
+                        conn.Close()
+                    }
+                    return
+                }
+                status := tt.statuses[len(tt.statuses)-1]
+                if int(n) <= len(tt.statuses) {
+                    status = tt.statuses[n-1]
+                }
+                w.WriteHeader(status)
+            }))
+            defer srv.Close()
+
+            resp, err := policy.doWithRetry(context.Background(), srv.Client(), "test", tt.idempotent, func(ctx context.Context) (*http.Request, error) {
+                return http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, nil)
+            })
+            if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+                t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+            }
+            if tt.wantStatus == 0 {
+                if err == nil {
+                    t.Errorf("status = %d, want an error", resp.StatusCode)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("error: %v", err)
+            }
+            defer resp.Body.Close()
+            if resp.StatusCode != tt.wantStatus {
+                t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+            }
+        })
+    }
+}
+
+func TestDoWithRetryBeforeSent(t *testing.T) {
+    // Nothing listens on the address, so the connection is refused before the request is sent
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    url := "http://" + listener.Addr().String()
+    listener.Close()
+
+    policy := retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, MaxElapsed: 5 * time.Second}
+    attempts := 0
+    _, err = policy.doWithRetry(context.Background(), http.DefaultClient, "test", false, func(ctx context.Context) (*http.Request, error) {
+        attempts++
+        return http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+    })
+    if err == nil {
+        t.Fatal("expected an error")
+    }
+    if attempts != 3 {
+        t.Errorf("attempts = %d, want 3 for a request that was never sent", attempts)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    policy := retryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, MaxElapsed: 5 * time.Second}
+    var attempts int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if atomic.AddInt32(&attempts, 1) < 2 {
+            w.Header().Set("Retry-After", "1")
+            w.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer srv.Close()
+
+    newRequest := func(ctx context.Context) (*http.Request, error) {
+        return http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+    }
+    start := time.Now()
+    resp, err := policy.doWithRetry(context.Background(), srv.Client(), "test", true, newRequest)
+    if err != nil || resp.StatusCode != http.StatusOK {
+        t.Fatalf("doWithRetry = %v, %v, want status 200", resp, err)
+    }
+    if elapsed := time.Since(start); elapsed < time.Second {
+        t.Errorf("retried after %v, want at least the Retry-After of 1s", elapsed)
+    }
+
+    // A Retry-After past the context's deadline returns the response instead of waiting
+    atomic.StoreInt32(&attempts, 0)
+    ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+    defer cancel()
+    resp, err = policy.doWithRetry(ctx, srv.Client(), "test", true, newRequest)
+    if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+        t.Fatalf("doWithRetry = %v, %v, want status 429", resp, err)
+    }
+
+    for value, want := range map[string]time.Duration{"": 0, "bogus": 0, "-1": 0, "3": 3 * time.Second} {
+        if got := parseRetryAfter(value); got != want {
+            t.Errorf("parseRetryAfter(%q) = %v, want %v", value, got, want)
+        }
+    }
+}
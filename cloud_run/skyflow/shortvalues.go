@@ -0,0 +1,136 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "unicode/utf8"
+)
+
+// Short value policies. A short value is a value with fewer characters than the column's minimum
+// length.
+const (
+    ShortValueTokenize = "tokenize" // Tokenize short values like any other value
+    ShortValuePad      = "pad"      // Pad short values to the minimum length before tokenizing
+    ShortValueNull     = "null"     // Replace short values with NULL
+    ShortValueRedact   = "redact"   // Replace short values with a redaction marker
+    ShortValueFail     = "fail"     // Fail the tokenize run
+)
+
+const (
+    // Character appended to pad short values. Invisible and not expected at the end of real
+    // values, so detokenize strips it from values of a padded length.
+    shortValuePad = "\u2063"
+    // Default replacement for short values under the redact policy
+    defaultRedactionMarker = "[REDACTED]"
+)
+
+// shortValuePolicy decides how the short values of a column are treated
+type shortValuePolicy struct {
+    Action    string
+    MinLength int
+    Marker    string
+}
+
+// defaultShortValuePolicy returns the policy of columns without one of their own, set with
+// SHORT_VALUE_POLICY and MIN_VALUE_LENGTH
+func defaultShortValuePolicy() shortValuePolicy {
+    policy := shortValuePolicy{
+        Action:    strings.ToLower(os.Getenv("SHORT_VALUE_POLICY")),
+        MinLength: getBatchSize("MIN_VALUE_LENGTH", 7),
+        Marker:    defaultRedactionMarker,
+    }
+    if policy.Action == "" {
+        policy.Action = ShortValueTokenize
+    }
+    if !validShortValuePolicy(policy.Action) {
+        log.Printf("[WARN] Unknown SHORT_VALUE_POLICY %q, tokenizing short values", policy.Action)
+        policy.Action = ShortValueTokenize
+    }
+    return policy
+}
+
+// shortValuePolicyFor returns the short value policy of a column of a table
+func shortValuePolicyFor(table tableRef, column string) (shortValuePolicy, error) {
+    return columnMappingFor(table, column).shortValuePolicy()
+}
+
+// shortValuePolicyForField returns the short value policy of the columns mapped to a Skyflow
+// field, so tokenize_value treats short values the way tokenize_table stored them
+func shortValuePolicyForField(field skyflowField) (shortValuePolicy, error) {
+    mappings := getRoleConfig().ColumnMappings
+    for i := range mappings {
+        if mappings[i].skyflowField() == field && mappings[i].ShortValuePolicy != "" {
+            return mappings[i].shortValuePolicy()
+        }
+    }
+    return defaultShortValuePolicy(), nil
+}
+
+// shortValuePolicy returns the short value policy of a mapping, filling in defaults. A nil
+// mapping has the default policy.
+func (m *ColumnMapping) shortValuePolicy() (shortValuePolicy, error) {
+    policy := defaultShortValuePolicy()
+    if m == nil {
+        return policy, nil
+    }
+    if m.ShortValuePolicy != "" {
+        policy.Action = strings.ToLower(m.ShortValuePolicy)
+        if !validShortValuePolicy(policy.Action) {
+            return policy, fmt.Errorf("invalid short value policy %q for column %s", m.ShortValuePolicy, m.Column)
+        }
+    }
+    if m.MinLength > 0 {
+        policy.MinLength = m.MinLength
+    }
+    if m.RedactionMarker != "" {
+        policy.Marker = m.RedactionMarker
+    }
+    return policy, nil
+}
+
+// validShortValuePolicy reports whether action is a known short value policy
+func validShortValuePolicy(action string) bool {
+    switch action {
+    case ShortValueTokenize, ShortValuePad, ShortValueNull, ShortValueRedact, ShortValueFail:
+        return true
+    }
+    return false
+}
+
+// isShort reports whether a value is shorter than the policy's minimum length
+func (p shortValuePolicy) isShort(value string) bool {
+    return utf8.RuneCountInString(value) < p.MinLength
+}
+
+// pad pads a short value to the policy's minimum length
+func (p shortValuePolicy) pad(value string) string {
+    return value + strings.Repeat(shortValuePad, p.MinLength-utf8.RuneCountInString(value))
+}
+
+// padLengths returns the lengths short values are padded to: the minimum lengths of the default
+// policy and of every column mapping with the pad policy
+func padLengths() map[int]bool {
+    lengths := make(map[int]bool)
+    if policy := defaultShortValuePolicy(); policy.Action == ShortValuePad {
+        lengths[policy.MinLength] = true
+    }
+    mappings := getRoleConfig().ColumnMappings
+    for i := range mappings {
+        if policy, err := mappings[i].shortValuePolicy(); err == nil && policy.Action == ShortValuePad {
+            lengths[policy.MinLength] = true
+        }
+    }
+    return lengths
+}
+
+// unpadValue removes the padding added to a short value before it was tokenized. Only values the
+// pad policy could have written are unpadded: values ending in padding that are exactly as long
+// as one of the padded lengths. Other values are returned as they are.
+func unpadValue(value string, lengths map[int]bool) string {
+    if !strings.HasSuffix(value, shortValuePad) || !lengths[utf8.RuneCountInString(value)] {
+        return value
+    }
+    return strings.TrimRight(value, shortValuePad)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestUnpadValue(t *testing.T) {
+    policy := shortValuePolicy{Action: ShortValuePad, MinLength: 7}
+    lengths := map[int]bool{7: true}
+    tests := []struct {
+        value string
+        want  string
+    }{
+        {value: policy.pad("abc"), want: "abc"},
+        {value: policy.pad("äbc"), want: "äbc"},
+        {value: policy.pad(""), want: ""},
+        {value: "abcdefg", want: "abcdefg"},
+        {value: "abc" + shortValuePad, want: "abc" + shortValuePad},
+        {value: "abcdefgh" + shortValuePad, want: "abcdefgh" + shortValuePad},
+        {value: "ab" + shortValuePad + "defg", want: "ab" + shortValuePad + "defg"},
+    }
+    for _, tt := range tests {
+        if got := unpadValue(tt.value, lengths); got != tt.want {
+            t.Errorf("unpadValue(%q) = %q, want %q", tt.value, got, tt.want)
+        }
+    }
+    if got := unpadValue(policy.pad("abc"), nil); got != policy.pad("abc") {
+        t.Errorf("unpadValue without a pad policy = %q, want the value unchanged", got)
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    _ "crypto/sha256"
+    _ "crypto/sha512"
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "strings"
+)
+
+// JWT signing algorithms
+const (
+    AlgorithmRS256 = "RS256"
+    AlgorithmRS384 = "RS384"
+    AlgorithmES256 = "ES256"
+    AlgorithmEdDSA = "EdDSA"
+)
+
+// keySigner signs with a private key the way a KMS asymmetric sign call does: RSA and ECDSA keys
+// sign the digest of the message, Ed25519 keys the message itself (hash is 0), and ECDSA
+// signatures are ASN.1 DER encoded. kmsSigner keeps the private key out of process memory.
+type keySigner interface {
+    Public() crypto.PublicKey
+    Sign(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+// localSigner is a keySigner holding the private key in memory
+type localSigner struct {
+    key crypto.Signer
+}
+
+func (s *localSigner) Public() crypto.PublicKey {
+    return s.key.Public()
+}
+
+func (s *localSigner) Sign(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+    return s.key.Sign(rand.Reader, digest, hash)
+}
+
+// jwtSigner signs JWTs with a Skyflow service account key
+type jwtSigner struct {
+    algorithm string
+    hash      crypto.Hash // Digest signed by the key, 0 for EdDSA
+    signer    keySigner
+}
+
+// newJWTSigner returns the signer for a Skyflow service account key: the Cloud KMS key version
+// if the credentials name one, else the PEM private key. The algorithm comes from KeyAlgorithm,
+// or from the key type if it isn't set.
+func newJWTSigner(ctx context.Context, creds *SkyflowCredentials) (*jwtSigner, error) {
+    var signer keySigner
+    switch {
+    case creds.SignerKeyName != "":
+        var err error
+        if signer, err = newKMSSigner(ctx, creds.SignerKeyName); err != nil {
+            return nil, fmt.Errorf("failed to create Cloud KMS signer for key %s: %v", creds.SignerKeyName, err)
+        }
+    default:
+        key, err := parsePrivateKey(creds.PrivateKey)
+        if err != nil {
+            return nil, err
+        }
+        signer = &localSigner{key: key}
+    }
+
+    algorithm, err := jwtAlgorithm(creds.KeyAlgorithm, signer.Public())
+    if err != nil {
+        return nil, err
+    }
+    s := &jwtSigner{algorithm: algorithm, signer: signer}
+    switch algorithm {
+    case AlgorithmRS256, AlgorithmES256:
+        s.hash = crypto.SHA256
+    case AlgorithmRS384:
+        s.hash = crypto.SHA384
+    }
+    return s, nil
+}
+
+// getSigner returns the key's JWT signer, created on first use
+func (c *SkyflowCredentials) getSigner(ctx context.Context) (*jwtSigner, error) {
+    c.signerMutex.Lock()
+    defer c.signerMutex.Unlock()
+    if c.signer == nil {
+        signer, err := newJWTSigner(ctx, c)
+        if err != nil {
+            return nil, err
+        }
+        c.signer = signer
+    }
+    return c.signer, nil
+}
+
+// parsePrivateKey parses a PEM private key: PKCS#8 ("PRIVATE KEY"), PKCS#1 ("RSA PRIVATE KEY")
+// or SEC1 ("EC PRIVATE KEY")
+func parsePrivateKey(privateKey string) (crypto.Signer, error) {
+    block, _ := pem.Decode([]byte(privateKey))
+    if block == nil {
+        return nil, errors.New("failed to parse PEM block containing the private key")
+    }
+
+    var key interface{}
+    var err error
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "EC PRIVATE KEY":
+        key, err = x509.ParseECPrivateKey(block.Bytes)
+    default:
+        key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", block.Type, err)
+    }
+
+    switch key := key.(type) {
+    case *rsa.PrivateKey:
+        return key, nil
+    case *ecdsa.PrivateKey:
+        return key, nil
+    case ed25519.PrivateKey:
+        return key, nil
+    }
+    return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// jwtAlgorithm returns the JWT algorithm for a key. keyAlgorithm is either a JWT algorithm or a
+// Skyflow key algorithm such as KEY_ALG_RSA_2048; the key must be of the algorithm's type.
+func jwtAlgorithm(keyAlgorithm string, public crypto.PublicKey) (string, error) {
+    var algorithm string
+    upper := strings.ToUpper(keyAlgorithm)
+    switch {
+    case upper == "RS256", upper == "RS384", upper == "ES256":
+        algorithm = upper
+    case upper == "EDDSA", strings.Contains(upper, "ED25519"):
+        algorithm = AlgorithmEdDSA
+    case strings.Contains(upper, "RSA"):
+        algorithm = AlgorithmRS256
+    case strings.Contains(upper, "ECDSA"), strings.Contains(upper, "_EC_"):
+        algorithm = AlgorithmES256
+    case upper == "":
+        // Infer from the key
+    default:
+        return "", fmt.Errorf("unsupported key algorithm %q", keyAlgorithm)
+    }
+
+    switch public := public.(type) {
+    case *rsa.PublicKey:
+        if algorithm == "" {
+            algorithm = AlgorithmRS256
+        }
+        if algorithm == AlgorithmRS256 || algorithm == AlgorithmRS384 {
+            return algorithm, nil
+        }
+    case *ecdsa.PublicKey:
+        if public.Curve != elliptic.P256() {
+            return "", fmt.Errorf("unsupported ECDSA curve %s, ES256 needs P-256", public.Curve.Params().Name)
+        }
+        if algorithm == "" || algorithm == AlgorithmES256 {
+            return AlgorithmES256, nil
+        }
+    case ed25519.PublicKey:
+        if algorithm == "" || algorithm == AlgorithmEdDSA {
+            return AlgorithmEdDSA, nil
+        }
+    default:
+        return "", fmt.Errorf("unsupported public key type %T", public)
+    }
+    return "", fmt.Errorf("key algorithm %s doesn't match the %T key", algorithm, public)
+}
+
+// sign returns the JWS signature of signingInput, the encoded JWT header and claims
+func (s *jwtSigner) sign(ctx context.Context, signingInput string) ([]byte, error) {
+    digest := []byte(signingInput)
+    if s.hash != 0 {
+        h := s.hash.New()
+        h.Write(digest)
+        digest = h.Sum(nil)
+    }
+    signature, err := s.signer.Sign(ctx, digest, s.hash)
+    if err != nil {
+        return nil, fmt.Errorf("failed to sign JWT with %s: %v", s.algorithm, err)
+    }
+    if s.algorithm == AlgorithmES256 {
+        return ecdsaJWSSignature(signature, 32)
+    }
+    return signature, nil
+}
+
+// ecdsaJWSSignature converts an ASN.1 DER ECDSA signature to the fixed size R || S form of JWS
+func ecdsaJWSSignature(der []byte, size int) ([]byte, error) {
+    var sig struct {
+        R, S *big.Int
+    }
+    if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) > 0 {
+        return nil, errors.New("invalid ECDSA signature")
+    }
+    if sig.R.BitLen() > size*8 || sig.S.BitLen() > size*8 {
+        return nil, errors.New("ECDSA signature too large for curve")
+    }
+    signature := make([]byte, 2*size)
+    sig.R.FillBytes(signature[:size])
+    sig.S.FillBytes(signature[size:])
+    return signature, nil
+}
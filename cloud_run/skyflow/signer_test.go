@@ -0,0 +1,191 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "math/big"
+    "strings"
+    "testing"
+)
+
+func encodePEM(blockType string, der []byte) string {
+    return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+func marshalPKCS8(t *testing.T, key interface{}) []byte {
+    t.Helper()
+    der, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return der
+}
+
+func TestGenerateJWTTokenSignatures(t *testing.T) {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sec1, err := x509.MarshalECPrivateKey(ecKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    verifyRSA := func(hash crypto.Hash) func([]byte, []byte) bool {
+        return func(input, sig []byte) bool {
+            h := hash.New()
+            h.Write(input)
+            return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, hash, h.Sum(nil), sig) == nil
+        }
+    }
+    verifyES256 := func(input, sig []byte) bool {
+        digest := sha256.Sum256(input)
+        if len(sig) != 64 {
+            return false
+        }
+        return ecdsa.Verify(&ecKey.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+    }
+    verifyEdDSA := func(input, sig []byte) bool {
+        return ed25519.Verify(edPublic, input, sig)
+    }
+
+    tests := []struct {
+        name         string
+        privateKey   string
+        keyAlgorithm string
+        want         string
+        verify       func(input, sig []byte) bool
+    }{
+        {"RSA PKCS#8", encodePEM("PRIVATE KEY", marshalPKCS8(t, rsaKey)), "", AlgorithmRS256, verifyRSA(crypto.SHA256)},
+        {"RSA Skyflow algorithm", encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), "KEY_ALG_RSA_2048", AlgorithmRS256, verifyRSA(crypto.SHA256)},
+        {"RSA RS384", encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), "RS384", AlgorithmRS384, verifyRSA(crypto.SHA384)},
+        {"ECDSA SEC1", encodePEM("EC PRIVATE KEY", sec1), "", AlgorithmES256, verifyES256},
+        {"ECDSA PKCS#8", encodePEM("PRIVATE KEY", marshalPKCS8(t, ecKey)), "ES256", AlgorithmES256, verifyES256},
+        {"Ed25519", encodePEM("PRIVATE KEY", marshalPKCS8(t, edKey)), "EdDSA", AlgorithmEdDSA, verifyEdDSA},
+    }
+    for _, tt := range tests {
+        creds := &SkyflowCredentials{
+            ClientID:     "client",
+            KeyID:        "key",
+            TokenURI:     "https://manage.skyflowapis.com/v1/auth/sa/oauth/token",
+            PrivateKey:   tt.privateKey,
+            KeyAlgorithm: tt.keyAlgorithm,
+        }
+        token, err := generateJWTToken(context.Background(), creds, testCaller)
+        if err != nil {
+            t.Errorf("%s: generateJWTToken error: %v", tt.name, err)
+            continue
+        }
+        parts := strings.Split(token, ".")
+        if len(parts) != 3 {
+            t.Errorf("%s: token has %d parts, want 3", tt.name, len(parts))
+            continue
+        }
+
+        var header struct {
+            Alg string `json:"alg"`
+        }
+        headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+        if err == nil {
+            err = json.Unmarshal(headerJSON, &header)
+        }
+        if err != nil {
+            t.Errorf("%s: invalid header: %v", tt.name, err)
+            continue
+        }
+        if header.Alg != tt.want {
+            t.Errorf("%s: alg = %s, want %s", tt.name, header.Alg, tt.want)
+        }
+
+        sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+        if err != nil {
+            t.Errorf("%s: invalid signature encoding: %v", tt.name, err)
+            continue
+        }
+        if !tt.verify([]byte(parts[0]+"."+parts[1]), sig) {
+            t.Errorf("%s: signature doesn't verify", tt.name)
+        }
+    }
+}
+
+func TestJWTAlgorithm(t *testing.T) {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecP384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name         string
+        keyAlgorithm string
+        public       crypto.PublicKey
+        want         string
+        wantErr      bool
+    }{
+        {name: "RSA default", public: &rsaKey.PublicKey, want: AlgorithmRS256},
+        {name: "RSA RS384", keyAlgorithm: "rs384", public: &rsaKey.PublicKey, want: AlgorithmRS384},
+        {name: "ECDSA default", public: &ecKey.PublicKey, want: AlgorithmES256},
+        {name: "Ed25519 default", public: edPublic, want: AlgorithmEdDSA},
+        {name: "ES256 with RSA key", keyAlgorithm: "ES256", public: &rsaKey.PublicKey, wantErr: true},
+        {name: "RS256 with ECDSA key", keyAlgorithm: "RS256", public: &ecKey.PublicKey, wantErr: true},
+        {name: "ECDSA P-384", public: &ecP384Key.PublicKey, wantErr: true},
+        {name: "unknown algorithm", keyAlgorithm: "HS256", public: &rsaKey.PublicKey, wantErr: true},
+    }
+    for _, tt := range tests {
+        got, err := jwtAlgorithm(tt.keyAlgorithm, tt.public)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("%s: jwtAlgorithm = %s, want error", tt.name, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: jwtAlgorithm error: %v", tt.name, err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s: jwtAlgorithm = %s, want %s", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestNewKMSSignerRejectsKeyNames(t *testing.T) {
+    for _, name := range []string{
+        "kms-key",
+        "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+        "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/",
+    } {
+        if _, err := newKMSSigner(context.Background(), name); err == nil {
+            t.Errorf("newKMSSigner(%q) accepted, want error", name)
+        }
+    }
+}
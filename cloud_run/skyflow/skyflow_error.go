@@ -0,0 +1,64 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// skyflowError is an error response from the Skyflow API, decoded from its error envelope:
+// {"error": {"http_code": 404, "grpc_code": 5, "http_status": "Not Found", "message": "..."}}
+type skyflowError struct {
+    Endpoint   string `json:"-"`
+    HTTPCode   int    `json:"http_code"`
+    GRPCCode   int    `json:"grpc_code"`
+    HTTPStatus string `json:"http_status"`
+    Message    string `json:"message"`
+    RequestID  string `json:"-"` // Skyflow's ID for the request, for correlating support tickets
+}
+
+func (e *skyflowError) Error() string {
+    message := fmt.Sprintf("Skyflow %s returned %d", e.Endpoint, e.HTTPCode)
+    if e.Message != "" {
+        message += ": " + e.Message
+    }
+    if e.RequestID != "" {
+        message += fmt.Sprintf(" (request ID %s)", e.RequestID)
+    }
+    return message
+}
+
+// bigQueryStatus maps the error to the status reported to BigQuery. Rate limiting, timeouts and
+// server errors are retryable; other client errors are not.
+func (e *skyflowError) bigQueryStatus() int {
+    switch {
+    case e.HTTPCode == http.StatusTooManyRequests:
+        return http.StatusTooManyRequests
+    case e.HTTPCode == http.StatusRequestTimeout, e.HTTPCode >= 500:
+        return http.StatusServiceUnavailable
+    default:
+        return http.StatusBadRequest
+    }
+}
+
+// parseSkyflowError decodes an error response of a Skyflow endpoint. Responses without the
+// error envelope keep their body as the message.
+func parseSkyflowError(endpoint string, resp *http.Response, body []byte) *skyflowError {
+    var envelope struct {
+        Error *skyflowError `json:"error"`
+    }
+    skyflowErr := &skyflowError{}
+    if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error != nil {
+        skyflowErr = envelope.Error
+    } else {
+        skyflowErr.Message = strings.TrimSpace(string(body))
+    }
+
+    skyflowErr.Endpoint = endpoint
+    if skyflowErr.HTTPCode == 0 {
+        skyflowErr.HTTPCode = resp.StatusCode
+    }
+    skyflowErr.RequestID = resp.Header.Get("X-Request-Id")
+    return skyflowErr
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "google.golang.org/api/googleapi"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    // Staging tables expire automatically in case cleanup fails or a run is abandoned
+    stagingTableExpiration = 7 * 24 * time.Hour
+)
+
+// tableRef identifies a BigQuery table
+type tableRef struct {
+    ProjectID string
+    DatasetID string
+    TableID   string
+}
+
+// String returns the fully qualified table name
+func (t tableRef) String() string {
+    return fmt.Sprintf("%s.%s.%s", t.ProjectID, t.DatasetID, t.TableID)
+}
+
+// sql returns the table name quoted for use in a query
+func (t tableRef) sql() string {
+    return "`" + t.String() + "`"
+}
+
+// Staged token of a value replaced with NULL. Skyflow tokens and redaction markers are never empty.
+const nullToken = ""
+
+// stagedToken is a row of the staging table mapping an original value of a column to its token
+type stagedToken struct {
+    ColumnName string `json:"column_name"`
+    Original   string `json:"original"`
+    Token      string `json:"token"`
+}
+
+// stagingTableSchema is the schema of the staging table holding stagedToken rows
+var stagingTableSchema = bigquery.Schema{
+    {Name: "column_name", Type: bigquery.StringFieldType, Required: true},
+    {Name: "original", Type: bigquery.StringFieldType, Required: true},
+    {Name: "token", Type: bigquery.StringFieldType, Required: true},
+}
+
+// table returns the BigQuery table handle for a table reference
+func (bq *bigQueryClient) table(t tableRef) *bigquery.Table {
+    return bq.client.DatasetInProject(t.ProjectID, t.DatasetID).Table(t.TableID)
+}
+
+// stagingTableFor returns the staging table of a tokenize run, next to the target table
+func stagingTableFor(target tableRef, runKey string) tableRef {
+    return tableRef{
+        ProjectID: target.ProjectID,
+        DatasetID: target.DatasetID,
+        TableID:   fmt.Sprintf("%s_skyflow_staging_%s", target.TableID, runKey),
+    }
+}
+
+// ensureStagingTable creates an expiring staging table unless it already exists. Reports
+// whether the table was created.
+func (bq *bigQueryClient) ensureStagingTable(ctx context.Context, staging tableRef) (bool, error) {
+    _, err := bq.table(staging).Metadata(ctx)
+    if err == nil {
+        return false, nil
+    }
+    var apiErr *googleapi.Error
+    if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+        return false, fmt.Errorf("error getting staging table %s: %v", staging, err)
+    }
+
+    err = bq.table(staging).Create(ctx, &bigquery.TableMetadata{
+        Schema:         stagingTableSchema,
+        ExpirationTime: time.Now().Add(stagingTableExpiration),
+    })
+    if err != nil {
+        return false, fmt.Errorf("error creating staging table %s: %v", staging, err)
+    }
+    return true, nil
+}
+
+// deleteStagingTable deletes a staging table once its tokens have been merged
+func (bq *bigQueryClient) deleteStagingTable(ctx context.Context, staging tableRef) {
+    if err := bq.table(staging).Delete(ctx); err != nil {
+        log.Printf("[WARN] Failed to delete staging table %s (it expires in %v): %v", staging, stagingTableExpiration, err)
+    }
+}
+
+// loadStagingTable loads original→token rows into a staging table with a load job
+func (bq *bigQueryClient) loadStagingTable(ctx context.Context, staging tableRef, rows []stagedToken) error {
+    var data bytes.Buffer
+    encoder := json.NewEncoder(&data)
+    for _, row := range rows {
+        if err := encoder.Encode(row); err != nil {
+            return fmt.Errorf("error encoding staging row: %v", err)
+        }
+    }
+
+    source := bigquery.NewReaderSource(&data)
+    source.SourceFormat = bigquery.JSON
+    source.Schema = stagingTableSchema
+
+    loader := bq.table(staging).LoaderFrom(source)
+    loader.WriteDisposition = bigquery.WriteAppend
+    loader.CreateDisposition = bigquery.CreateNever
+
+    job, err := loader.Run(ctx)
+    if err != nil {
+        return fmt.Errorf("error starting load job: %w", err)
+    }
+    status, err := job.Wait(ctx)
+    if err != nil {
+        return fmt.Errorf("error waiting for load job: %w", err)
+    }
+    if status.Err() != nil {
+        return fmt.Errorf("load job completed with error: %v", status.Err())
+    }
+    return nil
+}
+
+// stagedTokensQuery selects the staged tokens of the column named by the given query parameter.
+// Duplicate staged rows left by an interrupted run are collapsed. The output columns are prefixed
+// so they can't clash with column names in a row filter. Values replaced with NULL have a NULL
+// token.
+func stagedTokensQuery(staging tableRef, columnParam string) string {
+    return fmt.Sprintf(`
+    SELECT original AS _skyflow_original, NULLIF(ANY_VALUE(token), '') AS _skyflow_token
+    FROM %s
+    WHERE column_name = @%s
+    GROUP BY original`, staging.sql(), columnParam)
+}
+
+// stagedTokenLookup returns a function replacing a leaf value with its staged token, for updating
+// values nested in STRUCT and ARRAY columns. Values without a staged token are kept.
+func stagedTokenLookup(staging tableRef, columnParam string) func(string) string {
+    return func(leaf string) string {
+        return fmt.Sprintf("(SELECT IF(COUNT(*) = 0, %s, ANY_VALUE(_skyflow_token)) FROM (%s\n) WHERE _skyflow_original = %s)",
+            leaf, stagedTokensQuery(staging, columnParam), leaf)
+    }
+}
+
+// mergeStagedColumn replaces the original values of a column with their staged tokens in a
+// single MERGE statement, so values are never embedded in SQL text. Rerunning the merge is safe.
+// Only rows matching condition are updated. When touchUpdatedAt is set, updated_at is set on
+// every tokenized row. Nested paths are updated with updateStagedPath.
+func (bq *bigQueryClient) mergeStagedColumn(ctx context.Context, target tableRef, staging tableRef, column string, condition *rowCondition, touchUpdatedAt bool) error {
+    path, err := parseColumnPath(column)
+    if err != nil {
+        return err
+    }
+    if !path.isColumn() {
+        return bq.updateStagedPath(ctx, target, staging, path, condition, touchUpdatedAt)
+    }
+
+    set := fmt.Sprintf("%s = staged._skyflow_token", path.column())
+    if touchUpdatedAt {
+        set += ",\n    updated_at = CURRENT_TIMESTAMP()"
+    }
+    mergeQuery := fmt.Sprintf(`
+MERGE %s AS target
+USING (%s
+) AS staged
+ON target.%s = staged._skyflow_original
+WHEN MATCHED%s THEN UPDATE SET
+    %s`,
+        target.sql(),
+        stagedTokensQuery(staging, "column_name"),
+        path.column(),
+        condition.where(),
+        set)
+
+    params := append([]bigquery.QueryParameter{{Name: "column_name", Value: column}}, condition.parameters()...)
+    log.Printf("Executing merge for column %s", column)
+    if err := bq.Update(ctx, mergeQuery, params...); err != nil {
+        return fmt.Errorf("error updating table: %w", err)
+    }
+    return nil
+}
+
+// updateStagedPath replaces the leaf values of a nested column path with their staged tokens.
+// The path's top-level column is rebuilt with only the leaf values changed, in rows that contain
+// at least one staged value.
+func (bq *bigQueryClient) updateStagedPath(ctx context.Context, target tableRef, staging tableRef, path columnPath, condition *rowCondition, touchUpdatedAt bool) error {
+    set := fmt.Sprintf("%s = %s", path.column(), path.rewrite(stagedTokenLookup(staging, "column_name")))
+    if touchUpdatedAt {
+        set += ",\n    updated_at = CURRENT_TIMESTAMP()"
+    }
+    updateQuery := fmt.Sprintf(`
+UPDATE %s
+SET %s
+WHERE %s%s`,
+        target.sql(),
+        set,
+        path.containsAny("SELECT _skyflow_original FROM ("+stagedTokensQuery(staging, "column_name")+"\n)"),
+        condition.where())
+
+    params := append([]bigquery.QueryParameter{{Name: "column_name", Value: path.String()}}, condition.parameters()...)
+    log.Printf("Executing update for column %s", path)
+    if err := bq.Update(ctx, updateQuery, params...); err != nil {
+        return fmt.Errorf("error updating table: %w", err)
+    }
+    return nil
+}
+
+// writeTokenizedCopy writes a copy of source with the staged tokens applied to the given columns
+// to destination. The destination is created if needed and its contents are replaced; the source
+// is not modified. With a condition, only matching rows are copied and appended to the
+// destination. If commit is set, the rows are appended and commit is run in one transaction, so
+// a repeated run can't append the same rows twice. When touchUpdatedAt is set, updated_at is set
+// on every copied row. Top-level columns are joined with their staged tokens; nested paths are
+// rewritten one at a time in enclosing queries, so several paths may share a top-level column.
+func (bq *bigQueryClient) writeTokenizedCopy(ctx context.Context, source tableRef, staging tableRef, destination tableRef, columns []string, condition *rowCondition, touchUpdatedAt bool, commit *sqlStatement) error {
+    replacements := make([]string, 0, len(columns)+1)
+    joins := make([]string, 0, len(columns))
+    params := make([]bigquery.QueryParameter, 0, len(columns))
+    nested := make([]string, 0)
+    for i, column := range columns {
+        path, err := parseColumnPath(column)
+        if err != nil {
+            return err
+        }
+        param := fmt.Sprintf("column_%d", i)
+        params = append(params, bigquery.QueryParameter{Name: param, Value: column})
+        if !path.isColumn() {
+            nested = append(nested, fmt.Sprintf("%s AS %s", path.rewrite(stagedTokenLookup(staging, param)), path.column()))
+            continue
+        }
+
+        alias := fmt.Sprintf("staged_%d", i)
+        replacements = append(replacements, fmt.Sprintf("IF(%s._skyflow_original IS NULL, source.%s, %s._skyflow_token) AS %s",
+            alias, path.column(), alias, path.column()))
+        joins = append(joins, fmt.Sprintf("LEFT JOIN (%s\n) AS %s\nON source.%s = %s._skyflow_original",
+            stagedTokensQuery(staging, param), alias, path.column(), alias))
+    }
+    if touchUpdatedAt {
+        replacements = append(replacements, "CURRENT_TIMESTAMP() AS updated_at")
+    }
+
+    selectList := "source.*"
+    if len(replacements) > 0 {
+        selectList += fmt.Sprintf(" REPLACE (\n    %s\n)", strings.Join(replacements, ",\n    "))
+    }
+    copyQuery := fmt.Sprintf(`
+SELECT %s
+FROM %s AS source
+%s
+WHERE TRUE%s`,
+        selectList,
+        source.sql(),
+        strings.Join(joins, "\n"),
+        condition.where())
+    for _, replacement := range nested {
+        copyQuery = fmt.Sprintf("\nSELECT * REPLACE (%s)\nFROM (%s\n)", replacement, copyQuery)
+    }
+
+    params = append(params, condition.parameters()...)
+    if commit != nil {
+        // DDL can't run inside a transaction, so the destination is created empty beforehand
+        script := fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s AS
+SELECT * FROM (%s
+) LIMIT 0;
+BEGIN TRANSACTION;
+INSERT INTO %s
+%s;
+%s;
+COMMIT TRANSACTION;`,
+            destination.sql(), copyQuery, destination.sql(), copyQuery, commit.sql)
+
+        log.Printf("Appending tokenized copy of %s to %s", source, destination)
+        if err := bq.Update(ctx, script, append(params, commit.params...)...); err != nil {
+            return fmt.Errorf("error appending copy to %s: %v", destination, err)
+        }
+        return nil
+    }
+
+    q := bq.client.Query(copyQuery)
+    q.Parameters = params
+    q.Dst = bq.table(destination)
+    q.WriteDisposition = bigquery.WriteTruncate
+    if condition != nil {
+        q.WriteDisposition = bigquery.WriteAppend
+    }
+    q.CreateDisposition = bigquery.CreateIfNeeded
+
+    log.Printf("Writing tokenized copy of %s to %s", source, destination)
+    job, err := q.Run(ctx)
+    if err != nil {
+        return fmt.Errorf("error starting copy to %s: %v", destination, err)
+    }
+    status, err := job.Wait(ctx)
+    if err != nil {
+        return fmt.Errorf("error waiting for copy to %s: %v", destination, err)
+    }
+    if status.Err() != nil {
+        return fmt.Errorf("copy to %s completed with error: %v", destination, status.Err())
+    }
+    return nil
+}
+
+// readDistinctValues returns an iterator over the distinct non-empty values of a column path
+// greater than cursor in the rows matching condition, in ascending order. Arrays on the path are
+// flattened, so every element is read.
+func (bq *bigQueryClient) readDistinctValues(ctx context.Context, table tableRef, column string, cursor string, condition *rowCondition) (*bigquery.RowIterator, error) {
+    path, err := parseColumnPath(column)
+    if err != nil {
+        return nil, err
+    }
+    unnests, leaf := path.leaves("source")
+    from := table.sql() + " AS source"
+    for _, unnest := range unnests {
+        from += ", " + unnest
+    }
+
+    query := fmt.Sprintf(`
+SELECT DISTINCT %s AS value
+FROM %s
+WHERE %s > @cursor%s
+ORDER BY value`,
+        leaf,
+        from,
+        leaf,
+        condition.where())
+
+    params := append([]bigquery.QueryParameter{{Name: "cursor", Value: cursor}}, condition.parameters()...)
+    log.Printf("Reading values of column %s after checkpoint", column)
+    return bq.Read(ctx, query, params...)
+}
+
+// readDistinctRows returns an iterator over the distinct combinations of values of top-level
+// columns in the rows matching condition, for rows with a non-empty value in any of them. Each row
+// holds a sort key followed by the columns' values; rows are in ascending key order, starting
+// after cursor.
+func (bq *bigQueryClient) readDistinctRows(ctx context.Context, table tableRef, columns []string, cursor string, condition *rowCondition) (*bigquery.RowIterator, error) {
+    values := make([]string, len(columns))
+    selected := make([]string, len(columns))
+    present := make([]string, len(columns))
+    for i, column := range columns {
+        path, err := parseColumnPath(column)
+        if err != nil {
+            return nil, err
+        }
+        values[i] = "source." + path.column()
+        selected[i] = fmt.Sprintf("%s AS _skyflow_v%d", values[i], i)
+        present[i] = values[i] + " > ''"
+    }
+
+    query := fmt.Sprintf(`
+SELECT * FROM (
+    SELECT DISTINCT TO_JSON_STRING([%s]) AS _skyflow_key, %s
+    FROM %s AS source
+    WHERE (%s)%s
+)
+WHERE _skyflow_key > @cursor
+ORDER BY _skyflow_key`,
+        strings.Join(values, ", "),
+        strings.Join(selected, ", "),
+        table.sql(),
+        strings.Join(present, " OR "),
+        condition.where())
+
+    params := append([]bigquery.QueryParameter{{Name: "cursor", Value: cursor}}, condition.parameters()...)
+    log.Printf("Reading rows of columns %s after checkpoint", strings.Join(columns, ","))
+    return bq.Read(ctx, query, params...)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "google.golang.org/api/iterator"
+    "context"
+    "fmt"
+    "log"
+)
+
+// enableStorageRead switches large query results to the BigQuery Storage Read API, which streams
+// rows in Arrow format instead of paging them through the REST API. Ordered results are read on a
+// single stream, so rows still arrive in query order.
+func (bq *bigQueryClient) enableStorageRead(ctx context.Context) {
+    if err := bq.client.EnableStorageReadClient(ctx); err != nil {
+        log.Printf("[WARN] Storage Read API unavailable, reading through the REST API: %v", err)
+    }
+}
+
+// valueChunk is a chunk of distinct rows of string values read from BigQuery
+type valueChunk struct {
+    rows [][]string
+    err  error
+}
+
+// streamValueChunks reads rows of string values from it on a separate goroutine and sends them in
+// chunks of chunkSize. NULL values are read as empty strings, and rows whose first value, the sort
+// key, is NULL are skipped. At most bufferSize chunks wait to be processed; once the buffer is
+// full the reader blocks until the consumer catches up, so memory stays bounded regardless of
+// table size. Consecutive rows with the same sort key are dropped, which dedupes sorted input. A
+// read error is sent as the last chunk. Cancel ctx to stop the reader early.
+func streamValueChunks(ctx context.Context, it *bigquery.RowIterator, chunkSize int, bufferSize int) <-chan valueChunk {
+    chunks := make(chan valueChunk, bufferSize)
+
+    go func() {
+        defer close(chunks)
+
+        send := func(chunk valueChunk) bool {
+            select {
+            case chunks <- chunk:
+                return true
+            case <-ctx.Done():
+                return false
+            }
+        }
+
+        chunk := make([][]string, 0, chunkSize)
+        last, hasLast := "", false
+        for {
+            var row []bigquery.Value
+            err := it.Next(&row)
+            if err == iterator.Done {
+                break
+            }
+            if err != nil {
+                send(valueChunk{err: fmt.Errorf("error reading row: %w", err)})
+                return
+            }
+
+            key, ok := row[0].(string)
+            if !ok || (hasLast && key == last) {
+                continue
+            }
+            last, hasLast = key, true
+
+            values := make([]string, len(row))
+            for i, value := range row {
+                values[i], _ = value.(string)
+            }
+            chunk = append(chunk, values)
+            if len(chunk) == chunkSize {
+                if !send(valueChunk{rows: chunk}) {
+                    return
+                }
+                chunk = make([][]string, 0, chunkSize)
+            }
+        }
+
+        if len(chunk) > 0 {
+            send(valueChunk{rows: chunk})
+        }
+    }()
+
+    return chunks
+}
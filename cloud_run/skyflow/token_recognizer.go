@@ -0,0 +1,111 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// Token recognizer modes, selected with TOKEN_RECOGNIZER
+const (
+    RecognizerDetokenize = "detokenize" // Ask Skyflow whether each value resolves as a token; sends cleartext values to /detokenize
+    RecognizerUUID       = "uuid"       // Values shaped like UUIDs are tokens (default)
+    RecognizerRegex      = "regex"      // Values matching TOKEN_PATTERN are tokens
+    RecognizerNone       = "none"       // No value is treated as a token
+)
+
+// Shape of Skyflow's default (non format-preserving) tokens
+var uuidTokenPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// tokenRecognizer detects values that are already Skyflow tokens, so that tokenize_table never
+// tokenizes a token a second time
+type tokenRecognizer interface {
+    // recognize reports, for each value, whether it is already a token
+    recognize(ctx context.Context, values []string, userEmail string) ([]bool, error)
+}
+
+var (
+    recognizerOnce sync.Once
+    recognizer     tokenRecognizer
+)
+
+// getTokenRecognizer returns the token recognizer configured for the vault. Values are checked
+// by their shape unless detokenize is chosen explicitly, since that sends every cleartext value
+// to Skyflow before it is tokenized.
+func getTokenRecognizer() tokenRecognizer {
+    recognizerOnce.Do(func() {
+        mode := strings.ToLower(os.Getenv("TOKEN_RECOGNIZER"))
+        switch mode {
+        case "", RecognizerUUID:
+            recognizer = patternRecognizer{pattern: uuidTokenPattern}
+            mode = RecognizerUUID
+        case RecognizerDetokenize:
+            recognizer = detokenizeRecognizer{}
+            log.Printf("[WARN] TOKEN_RECOGNIZER is detokenize, cleartext values are sent to Skyflow /detokenize before they are tokenized")
+        case RecognizerRegex:
+            pattern, err := regexp.Compile(os.Getenv("TOKEN_PATTERN"))
+            if err != nil || os.Getenv("TOKEN_PATTERN") == "" {
+                log.Fatalf("[FATAL] TOKEN_RECOGNIZER is regex but TOKEN_PATTERN is not a valid pattern: %v", err)
+            }
+            recognizer = patternRecognizer{pattern: pattern}
+        case RecognizerNone:
+            recognizer = patternRecognizer{}
+        default:
+            log.Fatalf("[FATAL] Unknown TOKEN_RECOGNIZER: %s", mode)
+        }
+        log.Printf("[INFO] Using %s token recognizer", mode)
+    })
+    return recognizer
+}
+
+// patternRecognizer recognizes tokens by their shape. A nil pattern recognizes nothing.
+type patternRecognizer struct {
+    pattern *regexp.Regexp
+}
+
+func (r patternRecognizer) recognize(ctx context.Context, values []string, userEmail string) ([]bool, error) {
+    isToken := make([]bool, len(values))
+    if r.pattern == nil {
+        return isToken, nil
+    }
+    for i, value := range values {
+        isToken[i] = r.pattern.MatchString(value)
+    }
+    return isToken, nil
+}
+
+// detokenizeRecognizer recognizes tokens by detokenizing them with full redaction, which checks
+// that a token exists without returning its value. Works for format-preserving tokens that can't
+// be told apart from PII by their shape.
+type detokenizeRecognizer struct{}
+
+func (r detokenizeRecognizer) recognize(ctx context.Context, values []string, userEmail string) ([]bool, error) {
+    detokenizeReq := DetokenizeRequest{
+        DetokenizationParameters: make([]TokenParam, len(values)),
+        ContinueOnError:          true,
+    }
+    for i, value := range values {
+        detokenizeReq.DetokenizationParameters[i] = TokenParam{
+            Token:     value,
+            Redaction: "REDACTED",
+        }
+    }
+
+    resp, err := makeSkyflowAPIRequest[DetokenizeRequest, DetokenizeResponse](ctx, "/detokenize", detokenizeReq, userEmail, "")
+    if err != nil {
+        return nil, fmt.Errorf("error checking for existing tokens: %w", err)
+    }
+    if len(resp.Records) != len(values) {
+        return nil, fmt.Errorf("expected %d records in detokenize response, got %d", len(values), len(resp.Records))
+    }
+
+    isToken := make([]bool, len(values))
+    for i, record := range resp.Records {
+        isToken[i] = record.Error == nil
+    }
+    return isToken, nil
+}
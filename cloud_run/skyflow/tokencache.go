@@ -0,0 +1,184 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "log"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Lifetime assumed for bearer tokens whose expiry can't be determined
+const defaultBearerTokenLifetime = 30 * time.Minute
+
+// bearerTokenEntry is a cached Skyflow bearer token
+type bearerTokenEntry struct {
+    key        string
+    token      string
+    expiresAt  time.Time
+    refreshing bool // A background refresh is in progress
+}
+
+// bearerTokenCache keeps bearer tokens per cache key until they expire. The least recently used
+// entries are evicted beyond maxSize.
+type bearerTokenCache struct {
+    sync.Mutex
+    maxSize       int
+    refreshMargin time.Duration // Tokens expiring within the margin are refreshed in the background
+    entries       map[string]*list.Element
+    order         *list.List // Most recently used first
+}
+
+var (
+    bearerTokensOnce sync.Once
+    bearerTokens     *bearerTokenCache
+)
+
+// getBearerTokenCache returns the bearer token cache, configured with SKYFLOW_TOKEN_CACHE_SIZE
+// and SKYFLOW_TOKEN_REFRESH_MARGIN_SECONDS
+func getBearerTokenCache() *bearerTokenCache {
+    bearerTokensOnce.Do(func() {
+        bearerTokens = &bearerTokenCache{
+            maxSize:       getBatchSize("SKYFLOW_TOKEN_CACHE_SIZE", 1000),
+            refreshMargin: time.Duration(getBatchSize("SKYFLOW_TOKEN_REFRESH_MARGIN_SECONDS", 300)) * time.Second,
+            entries:       make(map[string]*list.Element),
+            order:         list.New(),
+        }
+    })
+    return bearerTokens
+}
+
+// get returns the unexpired token cached under key. refresh is set for the one caller that
+// should refresh a token about to expire.
+func (c *bearerTokenCache) get(key string) (token string, refresh bool, ok bool) {
+    c.Lock()
+    defer c.Unlock()
+    element, found := c.entries[key]
+    if !found {
+        return "", false, false
+    }
+    entry := element.Value.(*bearerTokenEntry)
+    remaining := time.Until(entry.expiresAt)
+    if remaining <= 0 {
+        c.order.Remove(element)
+        delete(c.entries, key)
+        return "", false, false
+    }
+    c.order.MoveToFront(element)
+    if remaining < c.refreshMargin && !entry.refreshing {
+        entry.refreshing = true
+        refresh = true
+    }
+    return entry.token, refresh, true
+}
+
+// put caches a token under key, evicting the least recently used tokens beyond the size limit
+func (c *bearerTokenCache) put(key string, token string, expiresAt time.Time) {
+    c.Lock()
+    defer c.Unlock()
+    if element, found := c.entries[key]; found {
+        entry := element.Value.(*bearerTokenEntry)
+        entry.token, entry.expiresAt, entry.refreshing = token, expiresAt, false
+        c.order.MoveToFront(element)
+        return
+    }
+    c.entries[key] = c.order.PushFront(&bearerTokenEntry{key: key, token: token, expiresAt: expiresAt})
+    for c.order.Len() > c.maxSize {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*bearerTokenEntry).key)
+    }
+}
+
+// refreshFailed lets a later caller retry the refresh of a token
+func (c *bearerTokenCache) refreshFailed(key string) {
+    c.Lock()
+    defer c.Unlock()
+    if element, found := c.entries[key]; found {
+        element.Value.(*bearerTokenEntry).refreshing = false
+    }
+}
+
+// evict removes the token cached under key if it is still the given token, so a token rejected
+// by Skyflow is fetched again
+func (c *bearerTokenCache) evict(key string, token string) {
+    c.Lock()
+    defer c.Unlock()
+    if element, found := c.entries[key]; found && element.Value.(*bearerTokenEntry).token == token {
+        c.order.Remove(element)
+        delete(c.entries, key)
+    }
+}
+
+// bearerTokenFetch is a token exchange in progress, shared by the requests for its cache key
+type bearerTokenFetch struct {
+    done  chan struct{}
+    token string
+    err   error
+}
+
+// Token exchanges in progress
+var bearerTokenFetches sync.Map // cache key -> *bearerTokenFetch
+
+// fetchSharedBearerToken fetches a bearer token and caches it under key. A request for a key
+// that is already being fetched waits for that exchange instead of starting another. The
+// exchange isn't cancelled with the request that started it, since others may be waiting.
+func fetchSharedBearerToken(ctx context.Context, key string, userEmail string, roleID string) (string, error) {
+    fetch := &bearerTokenFetch{done: make(chan struct{})}
+    if actual, loaded := bearerTokenFetches.LoadOrStore(key, fetch); loaded {
+        log.Printf("[DEBUG] Waiting for in-flight token exchange for cache key: %s", key)
+        fetch = actual.(*bearerTokenFetch)
+        select {
+        case <-fetch.done:
+            return fetch.token, fetch.err
+        case <-ctx.Done():
+            return "", ctx.Err()
+        }
+    }
+
+    fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+    defer cancel()
+    token, expiresAt, err := fetchBearerToken(fetchCtx, userEmail, roleID)
+    if err == nil {
+        log.Printf("[DEBUG] Successfully got bearer token expiring at %s, caching with key: %s",
+            expiresAt.Format(time.RFC3339), key)
+        getBearerTokenCache().put(key, token, expiresAt)
+    }
+
+    fetch.token, fetch.err = token, err
+    bearerTokenFetches.Delete(key)
+    close(fetch.done)
+    return token, err
+}
+
+// refreshBearerToken fetches a new token for a cache entry that is about to expire
+func refreshBearerToken(key string, userEmail string, roleID string) {
+    log.Printf("[DEBUG] Refreshing bearer token for cache key %s before it expires", key)
+    if _, err := fetchSharedBearerToken(context.Background(), key, userEmail, roleID); err != nil {
+        log.Printf("[WARN] Failed to refresh bearer token for cache key %s: %v", key, err)
+        getBearerTokenCache().refreshFailed(key)
+    }
+}
+
+// bearerTokenExpiry returns when a bearer token expires: expiresIn seconds from now if the token
+// response set it, else the exp claim of the token if it is a JWT, else the default lifetime
+func bearerTokenExpiry(token string, expiresIn float64) time.Time {
+    if expiresIn > 0 {
+        return time.Now().Add(time.Duration(expiresIn) * time.Second)
+    }
+    parts := strings.Split(token, ".")
+    if len(parts) == 3 {
+        var claims struct {
+            Exp int64 `json:"exp"`
+        }
+        if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+            if err := json.Unmarshal(payload, &claims); err == nil && claims.Exp > 0 {
+                return time.Unix(claims.Exp, 0)
+            }
+        }
+    }
+    return time.Now().Add(defaultBearerTokenLifetime)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+    "cloud.google.com/go/bigquery"
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+// watermark records how far incremental tokenize runs have read a table
+type watermark struct {
+    Table     string
+    Column    string
+    Value     string // Largest watermark column value tokenized by the last completed run
+    Pending   string // Upper bound of the run in progress, reused if the run is repeated
+    UpdatedAt time.Time
+}
+
+// watermarkStore persists the watermarks of incremental tokenize runs
+type watermarkStore interface {
+    Load(ctx context.Context, runKey string) (*watermark, error)
+    Save(ctx context.Context, runKey string, mark *watermark) error
+}
+
+var (
+    watermarksOnce sync.Once
+    watermarks     watermarkStore
+)
+
+// getWatermarkStore returns the configured watermark store
+func getWatermarkStore() watermarkStore {
+    watermarksOnce.Do(func() {
+        if tableName := os.Getenv("WATERMARKS_TABLE"); tableName != "" {
+            table, err := parseTableName(tableName)
+            if err != nil {
+                log.Fatalf("[FATAL] Invalid WATERMARKS_TABLE: %v", err)
+            }
+            watermarks = &bigQueryWatermarkStore{table: table}
+            log.Printf("[INFO] Using BigQuery watermark store: %s", table)
+            return
+        }
+        watermarks = newMemoryWatermarkStore()
+        log.Printf("[WARN] WATERMARKS_TABLE is not set, tokenize watermarks are kept in memory and lost on restart")
+    })
+    return watermarks
+}
+
+// resolveRowCondition resolves the row filter of a tokenize run. For a watermarked run the upper
+// bound is the current maximum of the watermark column, recorded as pending so a repeated run
+// covers exactly the same rows. Returns the condition, the watermark to commit once the run
+// completes (nil if none), and whether any rows can match.
+func resolveRowCondition(ctx context.Context, bq *bigQueryClient, runKey string, params *tokenizeTableParams) (*rowCondition, *watermark, bool, error) {
+    filter := params.Filter
+    if filter == nil {
+        return nil, nil, true, nil
+    }
+    if filter.WatermarkColumn == "" {
+        return filter.condition("", ""), nil, true, nil
+    }
+
+    store := getWatermarkStore()
+    mark, err := store.Load(ctx, runKey)
+    if err != nil {
+        return nil, nil, false, fmt.Errorf("error loading watermark: %w", err)
+    }
+    if mark == nil {
+        mark = &watermark{Table: params.Table.String(), Column: filter.WatermarkColumn}
+    }
+
+    if mark.Pending == "" {
+        high, err := bq.maxWatermark(ctx, params.Table, filter)
+        if err != nil {
+            return nil, nil, false, err
+        }
+        if high == "" || high == mark.Value {
+            log.Printf("No rows of %s past watermark %q of column %s", params.Table, mark.Value, filter.WatermarkColumn)
+            return nil, nil, false, nil
+        }
+        mark.Pending = high
+        mark.UpdatedAt = time.Now().UTC()
+        if err := store.Save(ctx, runKey, mark); err != nil {
+            return nil, nil, false, fmt.Errorf("error saving watermark: %w", err)
+        }
+    }
+
+    log.Printf("Tokenizing rows of %s with %s in (%q, %q]", params.Table, filter.WatermarkColumn, mark.Value, mark.Pending)
+    return filter.condition(mark.Value, mark.Pending), mark, true, nil
+}
+
+// commitWatermark advances a watermark to the upper bound of the completed run
+func commitWatermark(ctx context.Context, runKey string, mark *watermark) error {
+    mark.Value = mark.Pending
+    mark.Pending = ""
+    mark.UpdatedAt = time.Now().UTC()
+    if err := getWatermarkStore().Save(ctx, runKey, mark); err != nil {
+        return fmt.Errorf("error saving watermark: %w", err)
+    }
+    return nil
+}
+
+// sqlStatement is a SQL statement and the parameters it uses
+type sqlStatement struct {
+    sql    string
+    params []bigquery.QueryParameter
+}
+
+// watermarkCommitStatement returns the statement advancing a watermark to the upper bound of the
+// completed run, for running in the same transaction as the run's last write. Returns nil if the
+// watermark store isn't a BigQuery table; the watermark is then committed with commitWatermark.
+func watermarkCommitStatement(runKey string, mark *watermark) *sqlStatement {
+    store, ok := getWatermarkStore().(*bigQueryWatermarkStore)
+    if !ok {
+        return nil
+    }
+    committed := *mark
+    committed.Value = mark.Pending
+    committed.Pending = ""
+    committed.UpdatedAt = time.Now().UTC()
+    return store.saveStatement(runKey, &committed)
+}
+
+// maxWatermark returns the largest value of the filter's watermark column among the rows matching
+// its other conditions, as a string. Returns an empty string if no row has a value.
+func (bq *bigQueryClient) maxWatermark(ctx context.Context, table tableRef, filter *rowFilter) (string, error) {
+    bounds := *filter
+    bounds.WatermarkColumn = ""
+    condition := bounds.condition("", "")
+
+    query := fmt.Sprintf(`
+SELECT CAST(MAX(%s) AS STRING)
+FROM %s
+WHERE TRUE%s`,
+        quoteIdentifier(filter.WatermarkColumn),
+        table.sql(),
+        condition.where())
+
+    rows, err := bq.Query(ctx, query, condition.parameters()...)
+    if err != nil {
+        return "", fmt.Errorf("error reading watermark of table %s: %v", table, err)
+    }
+    if len(rows) == 0 {
+        return "", nil
+    }
+    return stringValue(rows[0][0]), nil
+}
+
+// memoryWatermarkStore keeps watermarks in memory. Used when no watermarks table is configured.
+type memoryWatermarkStore struct {
+    sync.Mutex
+    marks map[string]watermark
+}
+
+func newMemoryWatermarkStore() *memoryWatermarkStore {
+    return &memoryWatermarkStore{marks: make(map[string]watermark)}
+}
+
+func (s *memoryWatermarkStore) Load(ctx context.Context, runKey string) (*watermark, error) {
+    s.Lock()
+    defer s.Unlock()
+    mark, ok := s.marks[runKey]
+    if !ok {
+        return nil, nil
+    }
+    return &mark, nil
+}
+
+func (s *memoryWatermarkStore) Save(ctx context.Context, runKey string, mark *watermark) error {
+    s.Lock()
+    defer s.Unlock()
+    s.marks[runKey] = *mark
+    return nil
+}
+
+// bigQueryWatermarkStore keeps watermarks in a BigQuery control table (see sql/create_watermarks_table.sql)
+type bigQueryWatermarkStore struct {
+    table tableRef
+}
+
+func (s *bigQueryWatermarkStore) Load(ctx context.Context, runKey string) (*watermark, error) {
+    bq, err := newBigQueryClient()
+    if err != nil {
+        return nil, err
+    }
+    defer bq.Close()
+
+    query := fmt.Sprintf(`
+SELECT table_name, watermark_column, watermark, pending_watermark, updated_at
+FROM %s
+WHERE run_key = @run_key`, s.table.sql())
+    rows, err := bq.Query(ctx, query, bigquery.QueryParameter{Name: "run_key", Value: runKey})
+    if err != nil {
+        return nil, err
+    }
+    if len(rows) == 0 {
+        return nil, nil
+    }
+
+    row := rows[0]
+    mark := &watermark{
+        Table:   stringValue(row[0]),
+        Column:  stringValue(row[1]),
+        Value:   stringValue(row[2]),
+        Pending: stringValue(row[3]),
+    }
+    if updatedAt, ok := row[4].(time.Time); ok {
+        mark.UpdatedAt = updatedAt
+    }
+    return mark, nil
+}
+
+func (s *bigQueryWatermarkStore) Save(ctx context.Context, runKey string, mark *watermark) error {
+    statement := s.saveStatement(runKey, mark)
+    return executeControlQuery(ctx, statement.sql, statement.params)
+}
+
+// saveStatement returns the statement saving a watermark
+func (s *bigQueryWatermarkStore) saveStatement(runKey string, mark *watermark) *sqlStatement {
+    query := fmt.Sprintf(`
+MERGE %s AS target
+USING (SELECT @run_key AS run_key) AS source
+ON target.run_key = source.run_key
+WHEN MATCHED THEN UPDATE SET
+    watermark = @watermark, pending_watermark = @pending_watermark, updated_at = @updated_at
+WHEN NOT MATCHED THEN INSERT (run_key, table_name, watermark_column, watermark, pending_watermark, updated_at)
+    VALUES (@run_key, @table_name, @watermark_column, @watermark, @pending_watermark, @updated_at)`, s.table.sql())
+
+    return &sqlStatement{sql: query, params: []bigquery.QueryParameter{
+        {Name: "run_key", Value: runKey},
+        {Name: "table_name", Value: mark.Table},
+        {Name: "watermark_column", Value: mark.Column},
+        {Name: "watermark", Value: mark.Value},
+        {Name: "pending_watermark", Value: mark.Pending},
+        {Name: "updated_at", Value: mark.UpdatedAt},
+    }}
+}
@@ -8,11 +8,16 @@ DEFAULT_SKYFLOW_VAULT_ID="d77559286eb94afbba350625d7e31c05"
 DEFAULT_SKYFLOW_TABLE_NAME="pii"
 DEFAULT_SKYFLOW_INSERT_BATCH_SIZE="25"
 DEFAULT_SKYFLOW_DETOKENIZE_BATCH_SIZE="25"
+DEFAULT_SKYFLOW_INSERT_CONCURRENCY="4"
+DEFAULT_SKYFLOW_DETOKENIZE_CONCURRENCY="4"
 
 # Project configuration
 export PROJECT_ID="${PROJECT_ID:-$DEFAULT_PROJECT_ID}"
 export DATASET="${PREFIX}_skyflow"
 export TABLE="${PREFIX}_customer_data_platform"
+export JOBS_TABLE="${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_jobs"
+export CHECKPOINTS_TABLE="${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_checkpoints"
+export WATERMARKS_TABLE="${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_watermarks"
 export REGION="${REGION:-$DEFAULT_REGION}"
 
 # Cloud Run configuration
@@ -35,4 +40,55 @@ export SKYFLOW_SERVICE_NAME_HYPHENATED=$(echo "$SKYFLOW_SERVICE_NAME" | tr '_' '
 # Batch size configurations
 export SKYFLOW_INSERT_BATCH_SIZE="${SKYFLOW_INSERT_BATCH_SIZE:-$DEFAULT_SKYFLOW_INSERT_BATCH_SIZE}"
 export SKYFLOW_DETOKENIZE_BATCH_SIZE="${SKYFLOW_DETOKENIZE_BATCH_SIZE:-$DEFAULT_SKYFLOW_DETOKENIZE_BATCH_SIZE}"
-export BIGQUERY_UPDATE_BATCH_SIZE="1000"
+
+# Concurrent Skyflow batches per call, and batches started per second per instance (0 for no limit)
+export SKYFLOW_INSERT_CONCURRENCY="${SKYFLOW_INSERT_CONCURRENCY:-$DEFAULT_SKYFLOW_INSERT_CONCURRENCY}"
+export SKYFLOW_DETOKENIZE_CONCURRENCY="${SKYFLOW_DETOKENIZE_CONCURRENCY:-$DEFAULT_SKYFLOW_DETOKENIZE_CONCURRENCY}"
+export SKYFLOW_INSERT_RATE_LIMIT="${SKYFLOW_INSERT_RATE_LIMIT:-0}"
+export SKYFLOW_DETOKENIZE_RATE_LIMIT="${SKYFLOW_DETOKENIZE_RATE_LIMIT:-0}"
+
+# Retries of failed Skyflow and token exchange calls
+export SKYFLOW_RETRY_MAX_ATTEMPTS="${SKYFLOW_RETRY_MAX_ATTEMPTS:-4}"
+export SKYFLOW_RETRY_BASE_DELAY_MS="${SKYFLOW_RETRY_BASE_DELAY_MS:-200}"
+export SKYFLOW_RETRY_MAX_DELAY_MS="${SKYFLOW_RETRY_MAX_DELAY_MS:-5000}"
+export SKYFLOW_RETRY_MAX_ELAPSED_MS="${SKYFLOW_RETRY_MAX_ELAPSED_MS:-30000}"
+export REQUEST_TIMEOUT_SECONDS="${REQUEST_TIMEOUT_SECONDS:-300}"
+
+# Circuit breakers failing Skyflow calls fast while an endpoint is degraded
+export SKYFLOW_BREAKER_WINDOW_SECONDS="${SKYFLOW_BREAKER_WINDOW_SECONDS:-60}"
+export SKYFLOW_BREAKER_MIN_REQUESTS="${SKYFLOW_BREAKER_MIN_REQUESTS:-20}"
+export SKYFLOW_BREAKER_FAILURE_PERCENT="${SKYFLOW_BREAKER_FAILURE_PERCENT:-50}"
+export SKYFLOW_BREAKER_COOLDOWN_SECONDS="${SKYFLOW_BREAKER_COOLDOWN_SECONDS:-30}"
+
+# Bearer token cache
+export SKYFLOW_TOKEN_CACHE_SIZE="${SKYFLOW_TOKEN_CACHE_SIZE:-1000}"
+export SKYFLOW_TOKEN_REFRESH_MARGIN_SECONDS="${SKYFLOW_TOKEN_REFRESH_MARGIN_SECONDS:-300}"
+
+# Skyflow credential rotation
+export CREDENTIALS_POLL_SECONDS="${CREDENTIALS_POLL_SECONDS:-300}"
+export CREDENTIALS_OVERLAP_SECONDS="${CREDENTIALS_OVERLAP_SECONDS:-3600}"
+export CREDENTIALS_EXPIRY_WARNING_DAYS="${CREDENTIALS_EXPIRY_WARNING_DAYS:-14}"
+
+# Google group membership lookup (cloudidentity, static or none)
+export GROUP_DIRECTORY="${GROUP_DIRECTORY:-none}"
+export GROUP_DIRECTORY_FILE="${GROUP_DIRECTORY_FILE:-}"
+# Optional super admin access token (admin.directory.rolemanagement scope) the deploy uses to
+# assign the Groups Reader admin role for cloudidentity; without it the role is assigned manually
+export GROUP_DIRECTORY_ADMIN_TOKEN="${GROUP_DIRECTORY_ADMIN_TOKEN:-}"
+export GROUP_CACHE_TTL_SECONDS="${GROUP_CACHE_TTL_SECONDS:-300}"
+
+# IAM policy resolution across the project, folders and organization
+export IAM_ANCESTRY_CACHE_SECONDS="${IAM_ANCESTRY_CACHE_SECONDS:-3600}"
+export IAM_POLICY_CACHE_SECONDS="${IAM_POLICY_CACHE_SECONDS:-60}"
+# Folder and organization allow and deny policies the service account can't read (fail or skip)
+export IAM_UNREADABLE_ANCESTORS="${IAM_UNREADABLE_ANCESTORS:-fail}"
+
+# Existing token detection (uuid, regex, detokenize or none). detokenize recognizes
+# format-preserving tokens, but sends every cleartext value to Skyflow /detokenize before it is
+# tokenized: PII appears in detokenize requests and vault audit logs, and Skyflow calls double.
+export TOKEN_RECOGNIZER="${TOKEN_RECOGNIZER:-uuid}"
+export TOKEN_PATTERN="${TOKEN_PATTERN:-}"
+
+# Short value handling (tokenize, pad, null, redact or fail)
+export MIN_VALUE_LENGTH="${MIN_VALUE_LENGTH:-7}"
+export SHORT_VALUE_POLICY="${SHORT_VALUE_POLICY:-tokenize}"
@@ -39,6 +39,7 @@ install_prerequisites() {
     # Enable necessary APIs
     echo "Enabling necessary APIs..."
     gcloud services enable bigquery.googleapis.com
+    gcloud services enable bigquerystorage.googleapis.com
     gcloud services enable run.googleapis.com
     gcloud services enable cloudbuild.googleapis.com
     gcloud services enable iam.googleapis.com
@@ -68,7 +69,41 @@ deploy_cloud_run() {
     env_vars="$env_vars,PREFIX=$PREFIX"
     env_vars="$env_vars,SKYFLOW_INSERT_BATCH_SIZE=$SKYFLOW_INSERT_BATCH_SIZE"
     env_vars="$env_vars,SKYFLOW_DETOKENIZE_BATCH_SIZE=$SKYFLOW_DETOKENIZE_BATCH_SIZE"
-    env_vars="$env_vars,BIGQUERY_UPDATE_BATCH_SIZE=$BIGQUERY_UPDATE_BATCH_SIZE"
+    env_vars="$env_vars,SKYFLOW_INSERT_CONCURRENCY=$SKYFLOW_INSERT_CONCURRENCY"
+    env_vars="$env_vars,SKYFLOW_DETOKENIZE_CONCURRENCY=$SKYFLOW_DETOKENIZE_CONCURRENCY"
+    env_vars="$env_vars,SKYFLOW_INSERT_RATE_LIMIT=$SKYFLOW_INSERT_RATE_LIMIT"
+    env_vars="$env_vars,SKYFLOW_DETOKENIZE_RATE_LIMIT=$SKYFLOW_DETOKENIZE_RATE_LIMIT"
+    env_vars="$env_vars,SKYFLOW_RETRY_MAX_ATTEMPTS=$SKYFLOW_RETRY_MAX_ATTEMPTS"
+    env_vars="$env_vars,SKYFLOW_RETRY_BASE_DELAY_MS=$SKYFLOW_RETRY_BASE_DELAY_MS"
+    env_vars="$env_vars,SKYFLOW_RETRY_MAX_DELAY_MS=$SKYFLOW_RETRY_MAX_DELAY_MS"
+    env_vars="$env_vars,SKYFLOW_RETRY_MAX_ELAPSED_MS=$SKYFLOW_RETRY_MAX_ELAPSED_MS"
+    env_vars="$env_vars,REQUEST_TIMEOUT_SECONDS=$REQUEST_TIMEOUT_SECONDS"
+    env_vars="$env_vars,SKYFLOW_BREAKER_WINDOW_SECONDS=$SKYFLOW_BREAKER_WINDOW_SECONDS"
+    env_vars="$env_vars,SKYFLOW_BREAKER_MIN_REQUESTS=$SKYFLOW_BREAKER_MIN_REQUESTS"
+    env_vars="$env_vars,SKYFLOW_BREAKER_FAILURE_PERCENT=$SKYFLOW_BREAKER_FAILURE_PERCENT"
+    env_vars="$env_vars,SKYFLOW_BREAKER_COOLDOWN_SECONDS=$SKYFLOW_BREAKER_COOLDOWN_SECONDS"
+    env_vars="$env_vars,SKYFLOW_TOKEN_CACHE_SIZE=$SKYFLOW_TOKEN_CACHE_SIZE"
+    env_vars="$env_vars,SKYFLOW_TOKEN_REFRESH_MARGIN_SECONDS=$SKYFLOW_TOKEN_REFRESH_MARGIN_SECONDS"
+    env_vars="$env_vars,CREDENTIALS_POLL_SECONDS=$CREDENTIALS_POLL_SECONDS"
+    env_vars="$env_vars,CREDENTIALS_OVERLAP_SECONDS=$CREDENTIALS_OVERLAP_SECONDS"
+    env_vars="$env_vars,CREDENTIALS_EXPIRY_WARNING_DAYS=$CREDENTIALS_EXPIRY_WARNING_DAYS"
+    env_vars="$env_vars,GROUP_DIRECTORY=$GROUP_DIRECTORY"
+    env_vars="$env_vars,GROUP_CACHE_TTL_SECONDS=$GROUP_CACHE_TTL_SECONDS"
+    env_vars="$env_vars,IAM_ANCESTRY_CACHE_SECONDS=$IAM_ANCESTRY_CACHE_SECONDS"
+    env_vars="$env_vars,IAM_POLICY_CACHE_SECONDS=$IAM_POLICY_CACHE_SECONDS"
+    env_vars="$env_vars,IAM_UNREADABLE_ANCESTORS=$IAM_UNREADABLE_ANCESTORS"
+    env_vars="$env_vars,JOBS_TABLE=$JOBS_TABLE"
+    env_vars="$env_vars,CHECKPOINTS_TABLE=$CHECKPOINTS_TABLE"
+    env_vars="$env_vars,WATERMARKS_TABLE=$WATERMARKS_TABLE"
+    env_vars="$env_vars,TOKEN_RECOGNIZER=$TOKEN_RECOGNIZER"
+    env_vars="$env_vars,MIN_VALUE_LENGTH=$MIN_VALUE_LENGTH"
+    env_vars="$env_vars,SHORT_VALUE_POLICY=$SHORT_VALUE_POLICY"
+    if [ -n "$TOKEN_PATTERN" ]; then
+        env_vars="$env_vars,TOKEN_PATTERN=$TOKEN_PATTERN"
+    fi
+    if [ -n "$GROUP_DIRECTORY_FILE" ]; then
+        env_vars="$env_vars,GROUP_DIRECTORY_FILE=$GROUP_DIRECTORY_FILE"
+    fi
     
     # Deploy Cloud Run service and capture the endpoint
     local endpoint
@@ -76,6 +111,7 @@ deploy_cloud_run() {
         --source=. \
         --region=$REGION \
         --allow-unauthenticated \
+        --no-cpu-throttling \
         --set-env-vars "$env_vars" \
         --set-secrets CREDENTIALS_JSON=${PREFIX}_credentials:latest,ROLE_MAPPINGS_JSON=${PREFIX}_role_mappings:latest \
         --format="value(status.url)"); then
@@ -122,6 +158,20 @@ deploy_cloud_run() {
         cd "$current_dir"
         exit 1
     fi
+
+    # Let the Cloud Run service account read the allow and deny policies of the hierarchy
+    if ! grant_policy_review_access "${PROJECT_NUMBER}-compute@developer.gserviceaccount.com"; then
+        cd "$current_dir"
+        exit 1
+    fi
+
+    # Let the Cloud Run service account look up group memberships
+    if [ "$GROUP_DIRECTORY" == "cloudidentity" ]; then
+        if ! grant_group_directory_access "${PROJECT_NUMBER}-compute@developer.gserviceaccount.com"; then
+            cd "$current_dir"
+            exit 1
+        fi
+    fi
     
     # Return to original directory
     cd "$current_dir"
@@ -132,6 +182,149 @@ deploy_cloud_run() {
     echo "Cloud Run deployment successful for $SKYFLOW_SERVICE_NAME"
 }
 
+grant_policy_review_access() {
+    local service_account=$1
+    echo "Granting IAM policy read access on the project, its folders and its organization..."
+    echo "The project grant is required; folder and organization grants are attempted and warn on failure."
+
+    # Ancestors of the project, innermost first, as "ID TYPE" lines
+    local ancestors
+    if ! ancestors=$(gcloud projects get-ancestors $PROJECT_ID --format="value(id,type)"); then
+        echo "Error: Failed to get the ancestors of project $PROJECT_ID"
+        return 1
+    fi
+
+    local id type
+    while read -r id type; do
+        [ -z "$id" ] && continue
+        local roles="roles/iam.denyReviewer"
+        local command
+        case "$type" in
+            project)
+                command="gcloud projects add-iam-policy-binding"
+                ;;
+            folder)
+                command="gcloud resource-manager folders add-iam-policy-binding"
+                roles="$roles roles/iam.securityReviewer"
+                ;;
+            organization)
+                command="gcloud organizations add-iam-policy-binding"
+                roles="$roles roles/iam.securityReviewer"
+                ;;
+            *)
+                continue
+                ;;
+        esac
+        local role
+        for role in $roles; do
+            if $command "$id" \
+                --member="serviceAccount:${service_account}" \
+                --role="$role" \
+                --condition=None > /dev/null; then
+                echo "Granted $role on $type $id"
+                continue
+            fi
+            # The project grant is required; folders and the organization may need a higher-level admin
+            if [ "$type" == "project" ]; then
+                echo "Error: Failed to grant $role on project $id"
+                return 1
+            fi
+            echo "Warning: Failed to grant $role on $type $id. An admin of the $type must run:"
+            echo "    $command $id --member=\"serviceAccount:${service_account}\" --role=\"$role\" --condition=None"
+            echo "  Until then, requests fail unless IAM_UNREADABLE_ANCESTORS=skip is set, which ignores the $type's policies."
+        done
+    done <<< "$ancestors"
+}
+
+grant_group_directory_access() {
+    local service_account=$1
+    echo "Granting Cloud Identity group read access to $service_account..."
+
+    if ! gcloud services enable cloudidentity.googleapis.com admin.googleapis.com; then
+        echo "Error: Failed to enable the Cloud Identity API"
+        return 1
+    fi
+
+    # Admin roles are assigned through the Admin SDK by a Workspace or Cloud Identity super admin
+    local sa_id
+    sa_id=$(gcloud iam service-accounts describe "$service_account" --format="value(uniqueId)")
+    if [ -z "$sa_id" ]; then
+        echo "Error: Failed to get the unique ID of $service_account"
+        return 1
+    fi
+
+    # The deploy never logs in on its own; a super admin's token must be passed explicitly
+    local token=$GROUP_DIRECTORY_ADMIN_TOKEN
+    if [ -z "$token" ]; then
+        echo "Warning: Group lookups fail until $service_account (unique ID $sa_id) has the Groups Reader admin role."
+        echo "  A Workspace or Cloud Identity super admin can assign it in the Admin console"
+        echo "  (Account > Admin roles > Groups Reader > Assign service accounts), or redeploy with"
+        echo "  GROUP_DIRECTORY_ADMIN_TOKEN set to their access token with the"
+        echo "  https://www.googleapis.com/auth/admin.directory.rolemanagement scope."
+        return 0
+    fi
+    echo "Assigning the Groups Reader admin role with GROUP_DIRECTORY_ADMIN_TOKEN..."
+    local api="https://admin.googleapis.com/admin/directory/v1/customer/my_customer"
+
+    local role_id
+    role_id=$(curl -sf -H "Authorization: Bearer $token" "$api/roles?maxResults=100" | \
+        jq -r '[.items[]? | select(.roleName == "_GROUPS_READER_ADMIN_ROLE" or .roleDescription == "Groups Reader")][0].roleId // empty')
+    if [ -z "$role_id" ]; then
+        echo "Error: Groups Reader admin role not found"
+        return 1
+    fi
+
+    local existing
+    existing=$(curl -sf -H "Authorization: Bearer $token" "$api/roleassignments?roleId=$role_id&userKey=$sa_id" | jq -r '.items // [] | length')
+    if [ -z "$existing" ]; then
+        echo "Error: Failed to list Groups Reader admin role assignments"
+        return 1
+    fi
+    if [ "$existing" != "0" ]; then
+        echo "Groups Reader admin role already assigned to $service_account"
+        return 0
+    fi
+    if ! curl -sf -X POST -H "Authorization: Bearer $token" -H "Content-Type: application/json" \
+        -d "{\"roleId\": \"$role_id\", \"assignedTo\": \"$sa_id\", \"scopeType\": \"CUSTOMER\"}" \
+        "$api/roleassignments" > /dev/null; then
+        echo "Error: Failed to assign the Groups Reader admin role to $service_account"
+        return 1
+    fi
+    echo "Groups Reader admin role assigned to $service_account"
+}
+
+configure_caller_verification() {
+    echo "Configuring caller verification for $SKYFLOW_SERVICE_NAME..."
+
+    # Get the service account BigQuery uses to call the remote functions
+    local connection_sa
+    connection_sa=$(bq show --connection --format=json "${PROJECT_ID}.${REGION}.${CONNECTION_NAME}" | jq -r '.cloudResource.serviceAccountId')
+    if [ -z "$connection_sa" ] || [ "$connection_sa" == "null" ]; then
+        echo "Error: Failed to get service account for connection $CONNECTION_NAME"
+        exit 1
+    fi
+    echo "BigQuery connection service account: $connection_sa"
+
+    # Only accept ID tokens issued to the connection service account for this service's URL
+    if ! gcloud run services update "$SKYFLOW_SERVICE_NAME_HYPHENATED" \
+        --region="$REGION" \
+        --update-env-vars "SERVICE_URL=$SKYFLOW_ENDPOINT,ALLOWED_CALLER_SERVICE_ACCOUNTS=$connection_sa"; then
+        echo "Error: Failed to configure caller verification for $SKYFLOW_SERVICE_NAME"
+        exit 1
+    fi
+
+    # Add invoker permission for the BigQuery connection service account
+    if ! gcloud run services add-iam-policy-binding "$SKYFLOW_SERVICE_NAME_HYPHENATED" \
+        --region="$REGION" \
+        --member="serviceAccount:${connection_sa}" \
+        --role="roles/run.invoker"; then
+        echo "Error: Failed to add invoker binding for the BigQuery connection"
+        exit 1
+    fi
+
+    echo "Caller verification configured for $SKYFLOW_SERVICE_NAME"
+}
+
 deploy_services() {
     # Deploy unified Skyflow service
     deploy_cloud_run
@@ -130,6 +130,15 @@ create_components() {
     echo "Creating BigQuery table and inserting sample data..."
     cat "$(dirname "$0")/sql/insert_sample_data.sql" | envsubst | bq query --use_legacy_sql=false
 
+    echo "Creating tokenize jobs table..."
+    cat "$(dirname "$0")/sql/create_jobs_table.sql" | envsubst | bq query --use_legacy_sql=false
+
+    echo "Creating tokenize checkpoints table..."
+    cat "$(dirname "$0")/sql/create_checkpoints_table.sql" | envsubst | bq query --use_legacy_sql=false
+
+    echo "Creating tokenize watermarks table..."
+    cat "$(dirname "$0")/sql/create_watermarks_table.sql" | envsubst | bq query --use_legacy_sql=false
+
     # Deploy unified Skyflow service
     deploy_services
 
@@ -140,11 +149,19 @@ create_components() {
         --location="${REGION}" \
         "${CONNECTION_NAME}"
 
+    # Restrict the service to ID tokens from the connection's service account
+    configure_caller_verification
+
     echo "Creating BigQuery remote functions..."
     # Create all functions using unified service endpoint
     cat "$(dirname "$0")/sql/create_tokenize_table_function.sql" | envsubst | bq query --use_legacy_sql=false
     cat "$(dirname "$0")/sql/create_tokenize_value_function.sql" | envsubst | bq query --use_legacy_sql=false
     cat "$(dirname "$0")/sql/create_detokenize_function.sql" | envsubst | bq query --use_legacy_sql=false
+    cat "$(dirname "$0")/sql/create_tokenize_table_async_function.sql" | envsubst | bq query --use_legacy_sql=false
+    cat "$(dirname "$0")/sql/create_tokenize_table_to_function.sql" | envsubst | bq query --use_legacy_sql=false
+    cat "$(dirname "$0")/sql/create_tokenize_table_to_async_function.sql" | envsubst | bq query --use_legacy_sql=false
+    cat "$(dirname "$0")/sql/create_tokenize_table_incremental_function.sql" | envsubst | bq query --use_legacy_sql=false
+    cat "$(dirname "$0")/sql/create_job_status_function.sql" | envsubst | bq query --use_legacy_sql=false
 
     echo "Setup complete!"
 }
@@ -154,9 +171,17 @@ destroy_components() {
     bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize_table\`"
     bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize\`"
     bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_detokenize\`"
+    bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize_table_async\`"
+    bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize_table_to\`"
+    bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize_table_to_async\`"
+    bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize_table_incremental\`"
+    bq query --use_legacy_sql=false "DROP FUNCTION IF EXISTS \`${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_job_status\`"
 
     echo "Deleting BigQuery table..."
     bq rm -f -t "${PROJECT_ID}:${DATASET}.${TABLE}"
+    bq rm -f -t "${PROJECT_ID}:${DATASET}.${PREFIX}_skyflow_jobs"
+    bq rm -f -t "${PROJECT_ID}:${DATASET}.${PREFIX}_skyflow_checkpoints"
+    bq rm -f -t "${PROJECT_ID}:${DATASET}.${PREFIX}_skyflow_watermarks"
 
     echo "Deleting BigQuery dataset..."
     bq rm -f -d "${PROJECT_ID}:${DATASET}"
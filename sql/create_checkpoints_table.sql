@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS `${CHECKPOINTS_TABLE}` (
+    run_key STRING NOT NULL,
+    column_name STRING NOT NULL,
+    phase STRING NOT NULL,
+    cursor STRING,
+    value_count INT64,
+    skipped_count INT64,
+    short_values STRING,
+    updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE OR REPLACE FUNCTION `${DATASET}.${PREFIX}_skyflow_job_status`(
+    job_id STRING
+)
+RETURNS STRING
+REMOTE WITH CONNECTION `${PROJECT_ID}.${REGION}.${CONNECTION_NAME}`
+OPTIONS (
+    endpoint = '${SKYFLOW_ENDPOINT}',
+    user_defined_context = [
+        ("operation", "job_status")
+    ]
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS `${JOBS_TABLE}` (
+    job_id STRING NOT NULL,
+    state STRING NOT NULL,
+    params STRING,
+    requested_by STRING,
+    result STRING,
+    error STRING,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,13 @@
+CREATE OR REPLACE FUNCTION `${DATASET}.${PREFIX}_skyflow_tokenize_table_incremental`(
+    table_name STRING,
+    pii_columns STRING
+)
+RETURNS STRING
+REMOTE WITH CONNECTION `${PROJECT_ID}.${REGION}.${CONNECTION_NAME}`
+OPTIONS (
+    endpoint = '${SKYFLOW_ENDPOINT}',
+    user_defined_context = [
+        ("operation", "tokenize_table"),
+        ("watermark_column", "updated_at")
+    ]
+);
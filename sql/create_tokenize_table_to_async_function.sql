@@ -0,0 +1,14 @@
+CREATE OR REPLACE FUNCTION `${DATASET}.${PREFIX}_skyflow_tokenize_table_to_async`(
+    table_name STRING,
+    pii_columns STRING,
+    destination_table STRING
+)
+RETURNS STRING
+REMOTE WITH CONNECTION `${PROJECT_ID}.${REGION}.${CONNECTION_NAME}`
+OPTIONS (
+    endpoint = '${SKYFLOW_ENDPOINT}',
+    user_defined_context = [
+        ("operation", "tokenize_table"),
+        ("async", "true")
+    ]
+);
@@ -1,11 +1,11 @@
 CREATE OR REPLACE FUNCTION `${DATASET}.${PREFIX}_skyflow_tokenize`(
-    value STRING
+    value STRING,
+    skyflow_field STRING
 )
 RETURNS STRING
 REMOTE WITH CONNECTION `${PROJECT_ID}.${REGION}.${CONNECTION_NAME}`
 OPTIONS (
     endpoint = '${SKYFLOW_ENDPOINT}',
-    max_batching_rows = 1,
     user_defined_context = [
         ("operation", "tokenize_value")
     ]
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS `${WATERMARKS_TABLE}` (
+    run_key STRING NOT NULL,
+    table_name STRING NOT NULL,
+    watermark_column STRING NOT NULL,
+    watermark STRING,
+    pending_watermark STRING,
+    updated_at TIMESTAMP NOT NULL
+);
@@ -9,17 +9,17 @@ SELECT customer_id,
   ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_detokenize(email) as email,
   ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_detokenize(first_name) as first_name
 FROM ${PROJECT_ID}.${DATASET}.${TABLE}
-WHERE first_name = ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize('Jonathan');
+WHERE first_name = ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize('Jonathan', NULL);
 
 -- Example: Multiple conditions with tokenization
 SELECT * FROM ${PROJECT_ID}.${DATASET}.${TABLE}
-WHERE first_name = ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize('Jonathan')
-   OR email = ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize('jonathan@example.com');
+WHERE first_name = ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize('Jonathan', NULL)
+   OR email = ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize('jonathan@example.com', NULL);
 
 -- Example: Using IN clause with tokenization
 SELECT * FROM ${PROJECT_ID}.${DATASET}.${TABLE}
 WHERE email IN (
-    SELECT ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize(email)
+    SELECT ${PROJECT_ID}.${DATASET}.${PREFIX}_skyflow_tokenize(email, NULL)
     FROM new_emails_table
 );
 